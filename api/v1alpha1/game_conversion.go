@@ -0,0 +1,197 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+const (
+	// specAnnotation keeps the v1beta1 spec of a game served as v1alpha1, when
+	// it holds fields v1alpha1 has no place for, so that writing the game back
+	// through v1alpha1 does not lose them
+	specAnnotation = "operator.contrib.dosbox.com/v1beta1-spec"
+	// statusAnnotation keeps the v1beta1 status fields of a game served as
+	// v1alpha1 that v1alpha1 has no place for, so that writing the status back
+	// through v1alpha1 does not lose them
+	statusAnnotation = "operator.contrib.dosbox.com/v1beta1-status"
+)
+
+// hubStatus is the part of the v1beta1 status of a game v1alpha1 does not hold
+type hubStatus struct {
+	Phase          v1beta1.GamePhase              `json:"phase,omitempty"`
+	URL            string                         `json:"url,omitempty"`
+	RuntimeVersion string                         `json:"runtimeVersion,omitempty"`
+	Sessions       []v1beta1.GameSessionReference `json:"sessions,omitempty"`
+}
+
+// convertPhase returns the v1alpha1 phase closest to a v1beta1 one. An idle
+// game waits for a pod to be scheduled on the next request, a suspended game
+// has none, just like an undeployed one.
+func convertPhase(phase v1beta1.GamePhase) GamePhase {
+	switch phase {
+	case v1beta1.GamePhaseIdle:
+		return GamePhasePending
+	case v1beta1.GamePhaseSuspended:
+		return GamePhaseUndeployed
+	default:
+		return GamePhase(phase)
+	}
+}
+
+// ConvertTo converts this Game to the Hub version (v1beta1).
+func (src *Game) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.Game)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 Game but got a %T", dstRaw)
+	}
+
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+
+	restored := hubStatus{}
+	if data, ok := dst.Annotations[statusAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &restored); err != nil {
+			return fmt.Errorf("unable to restore the v1beta1 status: %w", err)
+		}
+
+		delete(dst.Annotations, statusAnnotation)
+	}
+
+	if data, ok := dst.Annotations[specAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &dst.Spec); err != nil {
+			return fmt.Errorf("unable to restore the v1beta1 spec: %w", err)
+		}
+
+		delete(dst.Annotations, specAnnotation)
+	} else {
+		// the v1beta1 fields of a game without the annotation are the ones
+		// the api server defaults them to
+		dst.Spec.Persistence.Mode = v1beta1.PersistenceModePersistentVolumeClaim
+		dst.Spec.Persistence.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+		dst.Spec.Exposure.Type = v1beta1.ExposureTypeClusterIP
+		dst.Spec.Exposure.Path = "/"
+	}
+
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	// the fields v1alpha1 does hold win over the restored ones, they are the
+	// ones a v1alpha1 client may have changed
+	dst.Spec.GameName = src.Spec.GameName
+	dst.Spec.Deploy = src.Spec.Deploy
+	dst.Spec.ForceRedeploy = src.Spec.ForceRedeploy
+	dst.Spec.Bundle.Url = src.Spec.Url
+	dst.Spec.Exposure.Port = src.Spec.Port
+	dst.Spec.Persistence.RetentionPolicy = v1beta1.RetentionPolicy(src.Spec.RetentionPolicy)
+
+	dst.Status = v1beta1.GameStatus{
+		Ready:              src.Status.Ready,
+		Phase:              v1beta1.GamePhase(src.Status.Phase),
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Endpoint:           src.Status.Endpoint,
+		BundleSize:         src.Status.BundleSize,
+		LastRedeployTime:   src.Status.LastRedeployTime,
+		Conditions:         src.Status.Conditions,
+		URL:                restored.URL,
+		RuntimeVersion:     restored.RuntimeVersion,
+		Sessions:           restored.Sessions,
+	}
+
+	// the restored phase only stands as long as a v1alpha1 client did not
+	// change the one it converts to
+	if restored.Phase != "" && convertPhase(restored.Phase) == src.Status.Phase {
+		dst.Status.Phase = restored.Phase
+	}
+
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1beta1) to this version.
+func (dst *Game) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.Game)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 Game but got a %T", srcRaw)
+	}
+
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+
+	dst.Spec = GameSpec{
+		GameName:        src.Spec.GameName,
+		Url:             src.Spec.Bundle.Url,
+		Deploy:          src.Spec.Deploy,
+		ForceRedeploy:   src.Spec.ForceRedeploy,
+		Port:            src.Spec.Exposure.Port,
+		RetentionPolicy: RetentionPolicy(src.Spec.Persistence.RetentionPolicy),
+	}
+
+	// only games using v1beta1 fields carry the annotation
+	converted := &v1beta1.Game{}
+	if err := dst.ConvertTo(converted); err != nil {
+		return err
+	}
+
+	if !equality.Semantic.DeepEqual(converted.Spec, src.Spec) {
+		data, err := json.Marshal(src.Spec)
+		if err != nil {
+			return fmt.Errorf("unable to preserve the v1beta1 spec: %w", err)
+		}
+
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[specAnnotation] = string(data)
+	}
+
+	dst.Status = GameStatus{
+		Ready:              src.Status.Ready,
+		Phase:              convertPhase(src.Status.Phase),
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Endpoint:           src.Status.Endpoint,
+		BundleSize:         src.Status.BundleSize,
+		LastRedeployTime:   src.Status.LastRedeployTime,
+		Conditions:         src.Status.Conditions,
+	}
+
+	dropped := hubStatus{
+		URL:            src.Status.URL,
+		RuntimeVersion: src.Status.RuntimeVersion,
+		Sessions:       src.Status.Sessions,
+	}
+	if GamePhase(src.Status.Phase) != dst.Status.Phase {
+		dropped.Phase = src.Status.Phase
+	}
+
+	if !equality.Semantic.DeepEqual(dropped, hubStatus{}) {
+		data, err := json.Marshal(dropped)
+		if err != nil {
+			return fmt.Errorf("unable to preserve the v1beta1 status: %w", err)
+		}
+
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[statusAnnotation] = string(data)
+	}
+
+	return nil
+}
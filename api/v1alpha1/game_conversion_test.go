@@ -0,0 +1,141 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	"github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGameConversionRoundTrip(t *testing.T) {
+	hub := &v1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+		Spec: v1beta1.GameSpec{
+			GameName: "Packman",
+			Deploy:   true,
+			Bundle: v1beta1.BundleSpec{
+				Url:                  "https://cdn.dos.zone/custom/dos/packman.jsdos",
+				Sha256:               "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+				CredentialsSecretRef: &corev1.LocalObjectReference{Name: "cdn-credentials"},
+			},
+			Exposure: v1beta1.ExposureSpec{
+				Port:    8080,
+				Type:    v1beta1.ExposureTypeIngress,
+				Host:    "packman.arcade.local",
+				Path:    "/",
+				Ingress: &v1beta1.IngressExposure{TLSSecretName: "arcade-tls"},
+			},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")},
+			},
+			Runtime:     v1beta1.RuntimeSpec{Version: "6.22.60"},
+			Persistence: v1beta1.PersistenceSpec{RetentionPolicy: v1beta1.RetentionPolicyRetain},
+		},
+		Status: v1beta1.GameStatus{Phase: v1beta1.GamePhaseRunning, Endpoint: "http://packman.default.svc:8080"},
+	}
+
+	spoke := &Game{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("converting from v1beta1: %v", err)
+	}
+
+	if spoke.Spec.Url != hub.Spec.Bundle.Url || spoke.Spec.Port != 8080 || spoke.Spec.RetentionPolicy != RetentionPolicyRetain {
+		t.Errorf("v1alpha1 spec is not converted: %+v", spoke.Spec)
+	}
+
+	// a v1alpha1 client changing a field it knows about must not lose the
+	// fields it does not
+	spoke.Spec.Deploy = false
+
+	converted := &v1beta1.Game{}
+	if err := spoke.ConvertTo(converted); err != nil {
+		t.Fatalf("converting to v1beta1: %v", err)
+	}
+
+	hub.Spec.Deploy = false
+	if !equality.Semantic.DeepEqual(hub, converted) {
+		t.Errorf("round trip is lossy:\nwant %+v\ngot  %+v", hub, converted)
+	}
+}
+
+func TestGameConversionWithoutV1beta1Fields(t *testing.T) {
+	hub := &v1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+		Spec: v1beta1.GameSpec{
+			GameName: "Packman",
+			Bundle:   v1beta1.BundleSpec{Url: "https://cdn.dos.zone/custom/dos/packman.jsdos"},
+			Exposure: v1beta1.ExposureSpec{Port: 80, Type: v1beta1.ExposureTypeClusterIP, Path: "/"},
+			Persistence: v1beta1.PersistenceSpec{
+				Mode:            v1beta1.PersistenceModePersistentVolumeClaim,
+				RetentionPolicy: v1beta1.RetentionPolicyDelete,
+				AccessModes:     []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			},
+		},
+	}
+
+	spoke := &Game{}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatalf("converting from v1beta1: %v", err)
+	}
+
+	if _, ok := spoke.Annotations[specAnnotation]; ok {
+		t.Errorf("%s annotation is set for a game v1alpha1 can fully express", specAnnotation)
+	}
+}
+
+func TestGameConversionStatus(t *testing.T) {
+	expiresAt := metav1.NewTime(metav1.Now().Rfc3339Copy().Time)
+	hub := &v1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+		Spec: v1beta1.GameSpec{
+			GameName: "Packman",
+			Bundle:   v1beta1.BundleSpec{Url: "https://cdn.dos.zone/custom/dos/packman.jsdos"},
+			Exposure: v1beta1.ExposureSpec{Port: 80, Type: v1beta1.ExposureTypeClusterIP, Path: "/"},
+			Persistence: v1beta1.PersistenceSpec{
+				Mode:        v1beta1.PersistenceModePersistentVolumeClaim,
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			},
+		},
+		Status: v1beta1.GameStatus{
+			Phase:          v1beta1.GamePhaseSuspended,
+			URL:            "http://packman.default.svc:80",
+			RuntimeVersion: "7.4.7",
+			Sessions: []v1beta1.GameSessionReference{
+				{Name: "packman-alice", Player: "alice", Phase: v1beta1.GamePhaseRunning, ExpiresAt: &expiresAt},
+			},
+		},
+	}
+
+	spoke := &Game{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("converting from v1beta1: %v", err)
+	}
+
+	if spoke.Status.Phase != GamePhaseUndeployed {
+		t.Errorf("suspended game is %s in v1alpha1, expected %s", spoke.Status.Phase, GamePhaseUndeployed)
+	}
+
+	// a v1alpha1 client writing the status back as it read it must not lose
+	// the fields it does not know about
+	converted := &v1beta1.Game{}
+	if err := spoke.ConvertTo(converted); err != nil {
+		t.Fatalf("converting to v1beta1: %v", err)
+	}
+
+	if !equality.Semantic.DeepEqual(hub.Status, converted.Status) || converted.Annotations != nil {
+		t.Errorf("status round trip is lossy:\nwant %+v\ngot  %+v %v", hub.Status, converted.Status, converted.Annotations)
+	}
+
+	// a phase the v1alpha1 client changed wins over the preserved one
+	spoke.Status.Phase = GamePhaseRunning
+	if err := spoke.ConvertTo(converted); err != nil {
+		t.Fatalf("converting to v1beta1: %v", err)
+	}
+
+	if converted.Status.Phase != v1beta1.GamePhaseRunning {
+		t.Errorf("phase changed through v1alpha1 is %s, expected %s", converted.Status.Phase, v1beta1.GamePhaseRunning)
+	}
+}
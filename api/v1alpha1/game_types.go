@@ -17,12 +17,25 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// RetentionPolicy decides what happens to the storage of a Game when it is deleted
+// +kubebuilder:validation:Enum=Delete;Retain
+type RetentionPolicy string
+
+const (
+	// RetentionPolicyDelete removes the pvc of the game and, once no other game
+	// in the namespace is deployed, the shared emulator assets pvc
+	RetentionPolicyDelete RetentionPolicy = "Delete"
+	// RetentionPolicyRetain keeps the pvc of the game and the shared emulator assets pvc
+	RetentionPolicyRetain RetentionPolicy = "Retain"
+)
+
 // GameSpec defines the desired state of Game
 type GameSpec struct {
 
@@ -39,6 +52,10 @@ type GameSpec struct {
 	// +kubebuilder:validation:Type=boolean
 	Deploy bool `json:"deploy"`
 
+	// ForceRedeploy rolls out a fresh pod, re-downloading the bundle, and is
+	// reset to false by the controller once the rollout has been triggered.
+	//
+	// Deprecated: set the dosbox.contrib/redeploy-at annotation instead.
 	// +optional
 	// +kubebuilder:default:=false
 	// +kubebuilder:validation:Type=boolean
@@ -52,11 +69,72 @@ type GameSpec struct {
 	// +kubebuilder:validation:ExclusiveMinimum=false
 	// +kubebuilder:validation:ExclusiveMaximum=false
 	Port int `json:"port,omitempty"`
+
+	// +optional
+	// +kubebuilder:default:=Delete
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
 }
 
+// GamePhase is a high level summary of where a Game is in its lifecycle
+// +kubebuilder:validation:Enum=Pending;Downloading;Starting;Running;Degraded;Undeployed
+type GamePhase string
+
+const (
+	// GamePhasePending means the Game is deployed but no pod has been scheduled yet
+	GamePhasePending GamePhase = "Pending"
+	// GamePhaseDownloading means the init containers are still fetching the bundle or the emulator assets
+	GamePhaseDownloading GamePhase = "Downloading"
+	// GamePhaseStarting means everything is downloaded and the engine is starting up
+	GamePhaseStarting GamePhase = "Starting"
+	// GamePhaseRunning means the game is up and serving
+	GamePhaseRunning GamePhase = "Running"
+	// GamePhaseDegraded means one of the containers of the game is failing
+	GamePhaseDegraded GamePhase = "Degraded"
+	// GamePhaseUndeployed means spec.deploy is false
+	GamePhaseUndeployed GamePhase = "Undeployed"
+)
+
+const (
+	// ConditionBundleFetched reports whether the game bundle has been downloaded
+	ConditionBundleFetched = "BundleFetched"
+	// ConditionAssetsReady reports whether the js-dos emulator assets are in place
+	ConditionAssetsReady = "AssetsReady"
+	// ConditionAvailable reports whether the game is ready to be played
+	ConditionAvailable = "Available"
+	// ConditionDegraded reports whether any container of the game is failing
+	ConditionDegraded = "Degraded"
+)
+
 // GameStatus defines the observed state of Game
 type GameStatus struct {
+	// +optional
 	Ready *bool `json:"ready,omitempty"`
+
+	// +optional
+	Phase GamePhase `json:"phase,omitempty"`
+
+	// ObservedGeneration is the generation of the spec the status was computed for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Endpoint is the in-cluster address of the game service
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// BundleSize is the size of the game bundle as reported by its source
+	// +optional
+	BundleSize *resource.Quantity `json:"bundleSize,omitempty"`
+
+	// LastRedeployTime is when the controller last rolled out a fresh pod
+	// +optional
+	LastRedeployTime *metav1.Time `json:"lastRedeployTime,omitempty"`
+
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
 //+kubebuilder:object:root=true
@@ -66,6 +144,10 @@ type GameStatus struct {
 // +kubebuilder:printcolumn:name="Game",type=string,JSONPath=`.spec.gameName`
 // +kubebuilder:printcolumn:name="Deploy",type=boolean,JSONPath=`.spec.deploy`
 // +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.status.endpoint`,priority=1
+// +kubebuilder:printcolumn:name="Size",type=string,JSONPath=`.status.bundleSize`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 type Game struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
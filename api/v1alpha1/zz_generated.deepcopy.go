@@ -22,6 +22,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -107,6 +108,22 @@ func (in *GameStatus) DeepCopyInto(out *GameStatus) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.BundleSize != nil {
+		in, out := &in.BundleSize, &out.BundleSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.LastRedeployTime != nil {
+		in, out := &in.LastRedeployTime, &out.LastRedeployTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GameStatus.
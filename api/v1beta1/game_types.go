@@ -0,0 +1,522 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RetentionPolicy decides what happens to the storage of a Game when it is deleted
+// +kubebuilder:validation:Enum=Delete;Retain
+type RetentionPolicy string
+
+const (
+	// RetentionPolicyDelete removes the pvc of the game and, once no other game
+	// in the namespace is deployed, the shared emulator assets pvc
+	RetentionPolicyDelete RetentionPolicy = "Delete"
+	// RetentionPolicyRetain keeps the pvc of the game and the shared emulator assets pvc
+	RetentionPolicyRetain RetentionPolicy = "Retain"
+)
+
+// PersistenceMode decides where the files of a Game are kept
+// +kubebuilder:validation:Enum=PersistentVolumeClaim;EmptyDir
+type PersistenceMode string
+
+const (
+	// PersistenceModePersistentVolumeClaim keeps the files of the game on a claim
+	PersistenceModePersistentVolumeClaim PersistenceMode = "PersistentVolumeClaim"
+	// PersistenceModeEmptyDir keeps the files of the game in an emptyDir of its
+	// pod, so they are downloaded again whenever the pod is replaced. Meant for
+	// ephemeral demo games.
+	PersistenceModeEmptyDir PersistenceMode = "EmptyDir"
+)
+
+// BundleSpec describes where the .jsdos bundle of a Game comes from and how
+// it is fetched. Exactly one source must be set.
+type BundleSpec struct {
+	// Url is the http(s) address the bundle is downloaded from
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^https?:\/\/(?:www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b(?:[-a-zA-Z0-9()@:%_\+.~#?&\/=]*)$`
+	Url string `json:"url,omitempty"`
+
+	// Oci is the reference of an OCI artifact holding the bundle, such as
+	// registry.local/games/doom:1.9. Append @sha256:<digest> to pull it by
+	// digest. The username and password of spec.bundle.credentialsSecretRef
+	// are used to log in to the registry.
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?::[0-9]+)?(?:\/[a-z0-9]+(?:[._-][a-z0-9]+)*)+(?::[\w][\w.-]{0,127})?(?:@sha256:[a-f0-9]{64})?$`
+	Oci string `json:"oci,omitempty"`
+
+	// ConfigMapRef selects the key of a configmap in the namespace of the game
+	// holding the bundle, as binary data. The key is the file name the bundle
+	// is served under.
+	// +optional
+	ConfigMapRef *corev1.ConfigMapKeySelector `json:"configMapRef,omitempty"`
+
+	// SecretRef selects the key of a secret in the namespace of the game
+	// holding the bundle. The key is the file name the bundle is served under.
+	// +optional
+	SecretRef *corev1.SecretKeySelector `json:"secretRef,omitempty"`
+
+	// PersistentVolumeClaimRef points at a bundle stored on a claim in the
+	// namespace of the game
+	// +optional
+	PersistentVolumeClaimRef *PersistentVolumeClaimBundleSource `json:"persistentVolumeClaimRef,omitempty"`
+
+	// Sha256 is the hex encoded digest the bundle must match. The game is not
+	// rolled out until the controller, or a job for bundles it does not read
+	// itself, verified it, and the pod verifies it again before serving it
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^[a-fA-F0-9]{64}$`
+	Sha256 string `json:"sha256,omitempty"`
+
+	// CredentialsSecretRef names a secret in the namespace of the game with the
+	// credentials the bundle is downloaded with: a username and a password key
+	// for basic auth, a token key for a bearer token and a headers key with any
+	// other http header, one "Name: value" per line
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// PersistentVolumeClaimBundleSource is a bundle stored on a persistent volume claim
+type PersistentVolumeClaimBundleSource struct {
+	// Name of the claim
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Path of the bundle relative to the root of the claim
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern:=`^[^/]`
+	Path string `json:"path"`
+}
+
+// ExposureType decides how a Game is reached from outside of the cluster
+// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer;Ingress;HTTPRoute
+type ExposureType string
+
+const (
+	// ExposureTypeClusterIP only exposes the game inside of the cluster
+	ExposureTypeClusterIP ExposureType = "ClusterIP"
+	// ExposureTypeNodePort exposes the game on a port of every node
+	ExposureTypeNodePort ExposureType = "NodePort"
+	// ExposureTypeLoadBalancer exposes the game through a load balancer of
+	// the cloud provider
+	ExposureTypeLoadBalancer ExposureType = "LoadBalancer"
+	// ExposureTypeIngress exposes the game through an Ingress
+	ExposureTypeIngress ExposureType = "Ingress"
+	// ExposureTypeHTTPRoute exposes the game through a Gateway API HTTPRoute
+	ExposureTypeHTTPRoute ExposureType = "HTTPRoute"
+)
+
+// ExposureSpec describes how a Game is reached
+type ExposureSpec struct {
+	// Port is the port of the service of the game
+	// +optional
+	// +kubebuilder:default=80
+	// +kubebuilder:validation:Type=integer
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:validation:ExclusiveMinimum=false
+	// +kubebuilder:validation:ExclusiveMaximum=false
+	Port int `json:"port,omitempty"`
+
+	// +optional
+	// +kubebuilder:default:=ClusterIP
+	Type ExposureType `json:"type,omitempty"`
+
+	// NodePort is the port of the nodes a game of type NodePort is exposed
+	// on. Picked by the cluster if not set.
+	// +optional
+	// +kubebuilder:validation:Minimum=30000
+	// +kubebuilder:validation:Maximum=32767
+	NodePort int32 `json:"nodePort,omitempty"`
+
+	// Host is the host name the Ingress or the HTTPRoute of the game routes
+	// to it. Any host is routed to the game if not set.
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^(\*\.)?[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	Host string `json:"host,omitempty"`
+
+	// Path is the path the game is served under, so that games can share a
+	// host behind one Ingress or Gateway, each under a path of its own such
+	// as /doom. The Ingress or the HTTPRoute of the game routes it there, and
+	// the page of the game loads the emulator assets and the bundle from it.
+	// +optional
+	// +kubebuilder:default:="/"
+	// +kubebuilder:validation:Pattern:=`^(/[A-Za-z0-9._~-]+)*/?$`
+	Path string `json:"path,omitempty"`
+
+	// Ingress configures the Ingress of a game of type Ingress
+	// +optional
+	Ingress *IngressExposure `json:"ingress,omitempty"`
+
+	// HTTPRoute configures the HTTPRoute of a game of type HTTPRoute
+	// +optional
+	HTTPRoute *HTTPRouteExposure `json:"httpRoute,omitempty"`
+}
+
+// IngressExposure describes the Ingress of a Game
+type IngressExposure struct {
+	// ClassName of the Ingress. Defaults to the default ingress class of the
+	// cluster.
+	// +optional
+	// +kubebuilder:validation:MaxLength:=253
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	ClassName *string `json:"className,omitempty"`
+
+	// TLSSecretName names a secret in the namespace of the game with the
+	// certificate of spec.exposure.host. The game is served over https if set.
+	// +optional
+	// +kubebuilder:validation:MaxLength:=253
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+
+	// Annotations are added to the Ingress, for the settings specific to an
+	// ingress controller or to cert-manager
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// HTTPRouteExposure describes the HTTPRoute of a Game
+type HTTPRouteExposure struct {
+	// ParentRefs are the gateways the route attaches to
+	// +kubebuilder:validation:MinItems=1
+	ParentRefs []GatewayReference `json:"parentRefs"`
+}
+
+// GatewayReference points at a listener of a Gateway
+type GatewayReference struct {
+	// Name of the gateway
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength:=253
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	Name string `json:"name"`
+
+	// Namespace of the gateway. Defaults to the namespace of the game.
+	// +optional
+	// +kubebuilder:validation:MaxLength:=63
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Namespace string `json:"namespace,omitempty"`
+
+	// SectionName is the name of the listener of the gateway the route
+	// attaches to. The route attaches to every listener allowing it if not set.
+	// +optional
+	// +kubebuilder:validation:MaxLength:=253
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// RuntimeSpec describes the js-dos runtime a Game runs on
+type RuntimeSpec struct {
+	// Version of js-dos, overriding the version the operator runs games on
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^[0-9A-Za-z][0-9A-Za-z.+-]*$`
+	Version string `json:"version,omitempty"`
+}
+
+// PersistenceSpec describes the storage of a Game
+type PersistenceSpec struct {
+	// +optional
+	// +kubebuilder:default:=PersistentVolumeClaim
+	Mode PersistenceMode `json:"mode,omitempty"`
+
+	// RetentionPolicy decides whether the claim of the game is kept once the
+	// game is deleted
+	// +optional
+	// +kubebuilder:default:=Delete
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
+
+	// Size of the claim of the game, or the size limit of its emptyDir.
+	// Defaults to the size of the bundle plus the headroom the manager is
+	// configured with, an emptyDir is not limited by default.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName of the claim of the game. Defaults to the default
+	// storage class of the cluster.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes of the claim of the game
+	// +optional
+	// +kubebuilder:default:={ReadWriteOnce}
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// VolumeMode of the claim of the game. Games are served from a
+	// filesystem, so Filesystem is the only mode supported.
+	// +optional
+	VolumeMode *corev1.PersistentVolumeMode `json:"volumeMode,omitempty"`
+}
+
+// GameSpec defines the desired state of Game
+type GameSpec struct {
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Type=string
+	GameName string `json:"gameName"`
+
+	// +kubebuilder:default:=false
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Type=boolean
+	Deploy bool `json:"deploy"`
+
+	// Suspend scales the game to zero while keeping its claim, its configmap
+	// and its service, so it resumes without downloading its bundle again
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Description of the game, shown on its page and in the arcade
+	// +optional
+	// +kubebuilder:validation:MaxLength=1024
+	Description string `json:"description,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:MaxLength=128
+	Publisher string `json:"publisher,omitempty"`
+
+	// Year the game was released in
+	// +optional
+	// +kubebuilder:validation:Minimum=1970
+	// +kubebuilder:validation:Maximum=2100
+	Year int `json:"year,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:MaxLength=63
+	Genre string `json:"genre,omitempty"`
+
+	// ThumbnailUrl is the http(s) address of a picture of the game, shown in
+	// the arcade and when a link to the game is shared
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^https?:\/\/(?:www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b(?:[-a-zA-Z0-9()@:%_\+.~#?&\/=]*)$`
+	ThumbnailUrl string `json:"thumbnailUrl,omitempty"`
+
+	// Controls are the keys the game is played with, shown in a help overlay
+	// on its page
+	// +optional
+	Controls []GameControl `json:"controls,omitempty"`
+
+	// Tags the game is found by. Every tag is also a label of the game.
+	// +optional
+	// +kubebuilder:validation:MaxItems=16
+	Tags []string `json:"tags,omitempty"`
+
+	// ForceRedeploy rolls out a fresh pod, re-downloading the bundle, and is
+	// reset to false by the controller once the rollout has been triggered.
+	//
+	// Deprecated: set the dosbox.contrib/redeploy-at annotation instead.
+	// +optional
+	// +kubebuilder:default:=false
+	// +kubebuilder:validation:Type=boolean
+	ForceRedeploy bool `json:"forceRedeploy,omitempty"`
+
+	// +kubebuilder:validation:Required
+	Bundle BundleSpec `json:"bundle"`
+
+	// +optional
+	Exposure ExposureSpec `json:"exposure,omitempty"`
+
+	// Resources are the compute resources of the container serving the game
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// +optional
+	Runtime RuntimeSpec `json:"runtime,omitempty"`
+
+	// RuntimeRef names the JsDosRuntime providing the emulator assets of the
+	// game, instead of the game downloading them itself
+	// +optional
+	RuntimeRef *corev1.LocalObjectReference `json:"runtimeRef,omitempty"`
+
+	// +optional
+	Persistence PersistenceSpec `json:"persistence,omitempty"`
+
+	// Idle scales the game to zero once nobody played it for a while. The
+	// game is started again by the first request reaching it.
+	// +optional
+	Idle *IdleSpec `json:"idle,omitempty"`
+}
+
+// IdleSpec is when a Game is scaled to zero for lack of traffic
+type IdleSpec struct {
+	// Minutes without a request after which the game is scaled to zero
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	Minutes int `json:"minutes"`
+}
+
+// GameControl is a key a Game is played with
+type GameControl struct {
+	// Keys pressed, such as "Ctrl" or "Arrow keys"
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Keys string `json:"keys"`
+
+	// Action the keys trigger in the game
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Action string `json:"action"`
+}
+
+// GamePhase is a high level summary of where a Game is in its lifecycle
+// +kubebuilder:validation:Enum=Pending;Downloading;Starting;Running;Degraded;Idle;Suspended;Undeployed
+type GamePhase string
+
+const (
+	// GamePhasePending means the Game is deployed but no pod has been scheduled yet
+	GamePhasePending GamePhase = "Pending"
+	// GamePhaseDownloading means the init containers are still fetching the bundle or the emulator assets
+	GamePhaseDownloading GamePhase = "Downloading"
+	// GamePhaseStarting means everything is downloaded and the engine is starting up
+	GamePhaseStarting GamePhase = "Starting"
+	// GamePhaseRunning means the game is up and serving
+	GamePhaseRunning GamePhase = "Running"
+	// GamePhaseDegraded means one of the containers of the game is failing
+	GamePhaseDegraded GamePhase = "Degraded"
+	// GamePhaseIdle means the Game was scaled to zero for lack of traffic
+	GamePhaseIdle GamePhase = "Idle"
+	// GamePhaseSuspended means spec.suspend is true
+	GamePhaseSuspended GamePhase = "Suspended"
+	// GamePhaseUndeployed means spec.deploy is false
+	GamePhaseUndeployed GamePhase = "Undeployed"
+)
+
+const (
+	// ConditionBundleFetched reports whether the game bundle has been downloaded
+	ConditionBundleFetched = "BundleFetched"
+	// ConditionBundleVerified reports whether the game bundle matches spec.bundle.sha256
+	ConditionBundleVerified = "BundleVerified"
+	// ConditionStorageReady reports whether the claim of the game is sized for
+	// its bundle, and the progress of growing it when the bundle outgrew it:
+	// Expanding in place, or BackingUp, Recreating and Restoring it when its
+	// storage class does not allow expansion
+	ConditionStorageReady = "StorageReady"
+	// ConditionAssetsReady reports whether the js-dos emulator assets are in place
+	ConditionAssetsReady = "AssetsReady"
+	// ConditionAvailable reports whether the game is ready to be played
+	ConditionAvailable = "Available"
+	// ConditionDegraded reports whether any container of the game is failing
+	ConditionDegraded = "Degraded"
+	// ConditionIdle reports whether a game with spec.idle was scaled to zero
+	// for lack of traffic
+	ConditionIdle = "Idle"
+	// ConditionSuspended reports whether the game is scaled to zero because
+	// of spec.suspend
+	ConditionSuspended = "Suspended"
+)
+
+// GameSessionReference is a GameSession of a game, as listed in its status
+type GameSessionReference struct {
+	Name   string `json:"name"`
+	Player string `json:"player"`
+
+	// +optional
+	Phase GamePhase `json:"phase,omitempty"`
+
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+// GameStatus defines the observed state of Game
+type GameStatus struct {
+	// +optional
+	Ready *bool `json:"ready,omitempty"`
+
+	// +optional
+	Phase GamePhase `json:"phase,omitempty"`
+
+	// ObservedGeneration is the generation of the spec the status was computed for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Endpoint is the in-cluster address of the game service
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// URL is the address players open the game at, as exposed by
+	// spec.exposure. Empty until the address is known, such as while a load
+	// balancer is provisioned.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// BundleSize is the size of the game bundle as reported by its source
+	// +optional
+	BundleSize *resource.Quantity `json:"bundleSize,omitempty"`
+
+	// RuntimeVersion is the js-dos version the game is deployed with
+	// +optional
+	RuntimeVersion string `json:"runtimeVersion,omitempty"`
+
+	// LastRedeployTime is when the controller last rolled out a fresh pod
+	// +optional
+	LastRedeployTime *metav1.Time `json:"lastRedeployTime,omitempty"`
+
+	// Sessions are the GameSessions running an instance of the game
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Sessions []GameSessionReference `json:"sessions,omitempty"`
+
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+
+// Game is the Schema for the games API
+// +kubebuilder:printcolumn:name="Game",type=string,JSONPath=`.spec.gameName`
+// +kubebuilder:printcolumn:name="Publisher",type=string,JSONPath=`.spec.publisher`,priority=1
+// +kubebuilder:printcolumn:name="Year",type=integer,JSONPath=`.spec.year`,priority=1
+// +kubebuilder:printcolumn:name="Genre",type=string,JSONPath=`.spec.genre`,priority=1
+// +kubebuilder:printcolumn:name="Deploy",type=boolean,JSONPath=`.spec.deploy`
+// +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.status.endpoint`,priority=1
+// +kubebuilder:printcolumn:name="Size",type=string,JSONPath=`.status.bundleSize`,priority=1
+// +kubebuilder:printcolumn:name="Runtime",type=string,JSONPath=`.status.runtimeVersion`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type Game struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GameSpec   `json:"spec,omitempty"`
+	Status GameStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GameList contains a list of Game
+type GameList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Game `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Game{}, &GameList{})
+}
@@ -0,0 +1,496 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net/http"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	gameNameMaxLength = 128
+
+	// GenreLabel, PublisherLabel and YearLabel are stamped on games with their
+	// genre, publisher and year, turned into label values
+	GenreLabel     = "dosbox.contrib/genre"
+	PublisherLabel = "dosbox.contrib/publisher"
+	YearLabel      = "dosbox.contrib/year"
+	// TagLabelPrefix is the prefix of the labels stamped on games for each
+	// of their tags, such as tag.dosbox.contrib/shooter: "true"
+	TagLabelPrefix = "tag.dosbox.contrib/"
+)
+
+var (
+	// log is for logging in this package.
+	gamelog = logf.Log.WithName("game-resource")
+
+	// zipMagic is the local file header signature every .jsdos bundle starts with
+	zipMagic = []byte("PK\x03\x04")
+)
+
+// gameWebhook defaults and validates Games. It needs a client, because ports
+// are validated against the other games of the namespace.
+// +kubebuilder:object:generate=false
+type gameWebhook struct {
+	client          client.Client
+	verifyBundleUrl bool
+}
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks of
+// Game. When verifyBundleUrl is set, the bundle of a game must be reachable and
+// be a zip archive to be admitted.
+func (r *Game) SetupWebhookWithManager(mgr ctrl.Manager, verifyBundleUrl bool) error {
+	webhook := &gameWebhook{
+		client:          mgr.GetClient(),
+		verifyBundleUrl: verifyBundleUrl,
+	}
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(webhook).
+		WithValidator(webhook).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-operator-contrib-dosbox-com-v1beta1-game,mutating=true,failurePolicy=fail,sideEffects=None,groups=operator.contrib.dosbox.com,resources=games,verbs=create;update,versions=v1beta1,name=mgame.kb.io,admissionReviewVersions=v1
+
+// Default implements admission.CustomDefaulter so a webhook will be registered for the type
+func (w *gameWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	game, ok := obj.(*Game)
+	if !ok {
+		return fmt.Errorf("expected a Game but got a %T", obj)
+	}
+
+	gamelog.Info("default", "name", game.Name)
+
+	if game.Spec.Exposure.Port == 0 {
+		game.Spec.Exposure.Port = 80
+	}
+
+	if game.Spec.Exposure.Type == "" {
+		game.Spec.Exposure.Type = ExposureTypeClusterIP
+	}
+
+	if game.Spec.Exposure.Path == "" {
+		game.Spec.Exposure.Path = "/"
+	}
+
+	if game.Spec.Persistence.Mode == "" {
+		game.Spec.Persistence.Mode = PersistenceModePersistentVolumeClaim
+	}
+
+	if game.Spec.Persistence.RetentionPolicy == "" {
+		game.Spec.Persistence.RetentionPolicy = RetentionPolicyDelete
+	}
+
+	if len(game.Spec.Persistence.AccessModes) == 0 {
+		game.Spec.Persistence.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+
+	setMetadataLabels(game)
+
+	return nil
+}
+
+// setMetadataLabels stamps the genre, the publisher, the year and the tags of
+// a game on it as labels, so games can be selected by them. Labels of values
+// that were removed from the spec are removed as well.
+func setMetadataLabels(game *Game) {
+	labels := map[string]string{}
+	for key, value := range game.Labels {
+		if key == GenreLabel || key == PublisherLabel || key == YearLabel || strings.HasPrefix(key, TagLabelPrefix) {
+			continue
+		}
+		labels[key] = value
+	}
+
+	if value := labelValue(game.Spec.Genre); value != "" {
+		labels[GenreLabel] = value
+	}
+
+	if value := labelValue(game.Spec.Publisher); value != "" {
+		labels[PublisherLabel] = value
+	}
+
+	if game.Spec.Year != 0 {
+		labels[YearLabel] = fmt.Sprint(game.Spec.Year)
+	}
+
+	for _, tag := range game.Spec.Tags {
+		if name := labelValue(tag); name != "" {
+			labels[TagLabelPrefix+name] = "true"
+		}
+	}
+
+	if len(labels) == 0 {
+		labels = nil
+	}
+	game.Labels = labels
+}
+
+// labelValue turns free text into a label value, or the name of a label:
+// lower case, with every run of characters other than letters, digits, '.',
+// '_' and '-' replaced by a dash, and at most 63 characters long
+func labelValue(text string) string {
+	var value strings.Builder
+	dash := false
+	for _, character := range strings.ToLower(text) {
+		if character < unicode.MaxASCII && (unicode.IsLetter(character) || unicode.IsDigit(character) || strings.ContainsRune("._-", character)) {
+			value.WriteRune(character)
+			dash = false
+		} else if !dash {
+			value.WriteRune('-')
+			dash = true
+		}
+	}
+
+	result := value.String()
+	if len(result) > 63 {
+		result = result[:63]
+	}
+
+	return strings.Trim(result, "._-")
+}
+
+//+kubebuilder:webhook:path=/validate-operator-contrib-dosbox-com-v1beta1-game,mutating=false,failurePolicy=fail,sideEffects=None,groups=operator.contrib.dosbox.com,resources=games,verbs=create;update,versions=v1beta1,name=vgame.kb.io,admissionReviewVersions=v1
+
+// ValidateCreate implements admission.CustomValidator so a webhook will be registered for the type
+func (w *gameWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	game, ok := obj.(*Game)
+	if !ok {
+		return fmt.Errorf("expected a Game but got a %T", obj)
+	}
+
+	gamelog.Info("validate create", "name", game.Name)
+
+	return w.validate(ctx, game, nil)
+}
+
+// ValidateUpdate implements admission.CustomValidator so a webhook will be registered for the type
+func (w *gameWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	game, ok := newObj.(*Game)
+	if !ok {
+		return fmt.Errorf("expected a Game but got a %T", newObj)
+	}
+
+	old, ok := oldObj.(*Game)
+	if !ok {
+		return fmt.Errorf("expected a Game but got a %T", oldObj)
+	}
+
+	gamelog.Info("validate update", "name", game.Name)
+
+	return w.validate(ctx, game, old)
+}
+
+// ValidateDelete implements admission.CustomValidator so a webhook will be registered for the type
+func (w *gameWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func (w *gameWebhook) validate(ctx context.Context, game *Game, old *Game) error {
+	// metadata only updates, like the controller managing its finalizer, must
+	// not be held back by games that were admitted before this webhook
+	if old != nil && equality.Semantic.DeepEqual(old.Spec, game.Spec) {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if old == nil {
+		nameErrs, err := w.validateName(ctx, field.NewPath("metadata", "name"), game)
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+		allErrs = append(allErrs, nameErrs...)
+	}
+
+	allErrs = append(allErrs, validateGameName(specPath.Child("gameName"), game.Spec.GameName)...)
+
+	if old != nil && old.Spec.GameName != game.Spec.GameName {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("gameName"), game.Spec.GameName, "field is immutable"))
+	}
+
+	allErrs = append(allErrs, validateBundleSource(specPath.Child("bundle"), game.Spec.Bundle)...)
+
+	if mode := game.Spec.Persistence.VolumeMode; mode != nil && *mode != corev1.PersistentVolumeFilesystem {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("persistence", "volumeMode"), *mode, []string{string(corev1.PersistentVolumeFilesystem)}))
+	}
+
+	if game.Spec.RuntimeRef != nil && game.Spec.Runtime.Version != "" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("runtime", "version"), "may not be set together with spec.runtimeRef, the version is the one of the runtime"))
+	}
+
+	allErrs = append(allErrs, validateExposure(specPath.Child("exposure"), game.Spec.Exposure)...)
+
+	portErrs, err := w.validatePort(ctx, specPath.Child("exposure", "port"), game)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	allErrs = append(allErrs, portErrs...)
+
+	// private bundles are left to the controller, which reads their credentials
+	if w.verifyBundleUrl && game.Spec.Bundle.Url != "" && game.Spec.Bundle.CredentialsSecretRef == nil &&
+		(old == nil || old.Spec.Bundle.Url != game.Spec.Bundle.Url) {
+		if err := verifyBundleUrl(ctx, game.Spec.Bundle.Url); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("bundle", "url"), game.Spec.Bundle.Url, err.Error()))
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("Game").GroupKind(), game.Name, allErrs)
+}
+
+func validateGameName(path *field.Path, gameName string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if strings.TrimSpace(gameName) == "" {
+		return append(allErrs, field.Required(path, "must not be blank"))
+	}
+
+	if strings.TrimSpace(gameName) != gameName {
+		allErrs = append(allErrs, field.Invalid(path, gameName, "must not start or end with whitespace"))
+	}
+
+	if len(gameName) > gameNameMaxLength {
+		allErrs = append(allErrs, field.TooLong(path, gameName, gameNameMaxLength))
+	}
+
+	for _, character := range gameName {
+		if !unicode.IsPrint(character) {
+			allErrs = append(allErrs, field.Invalid(path, gameName, "must only contain printable characters"))
+			break
+		}
+	}
+
+	return allErrs
+}
+
+// validateBundleSource makes sure the bundle comes from exactly one source
+func validateBundleSource(path *field.Path, bundle BundleSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	sources := map[string]bool{
+		"url":                      bundle.Url != "",
+		"oci":                      bundle.Oci != "",
+		"configMapRef":             bundle.ConfigMapRef != nil,
+		"secretRef":                bundle.SecretRef != nil,
+		"persistentVolumeClaimRef": bundle.PersistentVolumeClaimRef != nil,
+	}
+
+	var set []string
+	for source, ok := range sources {
+		if ok {
+			set = append(set, source)
+		}
+	}
+	sort.Strings(set)
+
+	switch len(set) {
+	case 0:
+		allErrs = append(allErrs, field.Required(path, "one of url, oci, configMapRef, secretRef or persistentVolumeClaimRef must be set"))
+	case 1:
+	default:
+		allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("only one source may be set, found %s", strings.Join(set, ", "))))
+	}
+
+	// keys and paths end up in the script of the init container and in the
+	// page of the game
+	if bundle.ConfigMapRef != nil {
+		for _, message := range validation.IsConfigMapKey(bundle.ConfigMapRef.Key) {
+			allErrs = append(allErrs, field.Invalid(path.Child("configMapRef", "key"), bundle.ConfigMapRef.Key, message))
+		}
+	}
+
+	if bundle.SecretRef != nil {
+		for _, message := range validation.IsConfigMapKey(bundle.SecretRef.Key) {
+			allErrs = append(allErrs, field.Invalid(path.Child("secretRef", "key"), bundle.SecretRef.Key, message))
+		}
+	}
+
+	if bundle.PersistentVolumeClaimRef != nil {
+		allErrs = append(allErrs, validateBundlePath(path.Child("persistentVolumeClaimRef", "path"), bundle.PersistentVolumeClaimRef.Path)...)
+	}
+
+	return allErrs
+}
+
+// validateBundlePath makes sure the path of a bundle on a claim is a clean
+// relative path that stays on the claim
+func validateBundlePath(path *field.Path, bundlePath string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if filepath.IsAbs(bundlePath) || filepath.Clean(bundlePath) != bundlePath {
+		allErrs = append(allErrs, field.Invalid(path, bundlePath, "must be a clean relative path"))
+	}
+
+	for _, segment := range strings.Split(bundlePath, "/") {
+		if segment == "." || segment == ".." {
+			allErrs = append(allErrs, field.Invalid(path, bundlePath, "must not contain . or .. segments"))
+			break
+		}
+	}
+
+	for _, character := range bundlePath {
+		if unicode.IsControl(character) || strings.ContainsRune("\"'`$\\", character) {
+			allErrs = append(allErrs, field.Invalid(path, bundlePath, "must not contain control characters, quotes, backslashes or $"))
+			break
+		}
+	}
+
+	return allErrs
+}
+
+// validateExposure makes sure the settings of the exposure are the ones of its type
+func validateExposure(path *field.Path, exposure ExposureSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if exposure.NodePort != 0 && exposure.Type != ExposureTypeNodePort {
+		allErrs = append(allErrs, field.Forbidden(path.Child("nodePort"), "may only be set for type NodePort"))
+	}
+
+	for _, segment := range strings.Split(exposure.Path, "/") {
+		if segment == "." || segment == ".." {
+			allErrs = append(allErrs, field.Invalid(path.Child("path"), exposure.Path, "must not contain . or .. segments"))
+			break
+		}
+	}
+
+	if exposure.Ingress != nil && exposure.Type != ExposureTypeIngress {
+		allErrs = append(allErrs, field.Forbidden(path.Child("ingress"), "may only be set for type Ingress"))
+	}
+
+	if exposure.Ingress != nil && exposure.Ingress.TLSSecretName != "" && exposure.Host == "" {
+		allErrs = append(allErrs, field.Required(path.Child("host"), "must be set to serve the game over https"))
+	}
+
+	switch {
+	case exposure.Type == ExposureTypeHTTPRoute && exposure.HTTPRoute == nil:
+		allErrs = append(allErrs, field.Required(path.Child("httpRoute"), "must be set for type HTTPRoute"))
+	case exposure.Type != ExposureTypeHTTPRoute && exposure.HTTPRoute != nil:
+		allErrs = append(allErrs, field.Forbidden(path.Child("httpRoute"), "may only be set for type HTTPRoute"))
+	}
+
+	return allErrs
+}
+
+// validatePort rejects a deployed game whose port is already taken by another
+// deployed game of the same namespace.
+func (w *gameWebhook) validatePort(ctx context.Context, path *field.Path, game *Game) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+
+	// games routed to through an ingress or a gateway share their host and
+	// port, each behind a service of its own
+	if !game.Spec.Deploy || routed(game.Spec.Exposure) {
+		return allErrs, nil
+	}
+
+	games := &GameList{}
+	if err := w.client.List(ctx, games, client.InNamespace(game.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for _, other := range games.Items {
+		if other.Name == game.Name || !other.Spec.Deploy || !other.DeletionTimestamp.IsZero() || routed(other.Spec.Exposure) {
+			continue
+		}
+
+		if other.Spec.Exposure.Port == game.Spec.Exposure.Port {
+			allErrs = append(allErrs, field.Invalid(path, game.Spec.Exposure.Port, fmt.Sprintf("already used by game %s", other.Name)))
+			break
+		}
+	}
+
+	return allErrs, nil
+}
+
+// validateName makes sure a new game is not named after the instance of a
+// session, whose resources would then be fought over by both
+func (w *gameWebhook) validateName(ctx context.Context, path *field.Path, game *Game) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+
+	sessions := &GameSessionList{}
+	if err := w.client.List(ctx, sessions, client.InNamespace(game.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions.Items {
+		if session.InstanceName() == game.Name {
+			allErrs = append(allErrs, field.Invalid(path, game.Name, fmt.Sprintf("already used by the instance of session %s", session.Name)))
+			break
+		}
+	}
+
+	return allErrs, nil
+}
+
+// routed reports whether a game is reached through an ingress or a gateway
+// rather than its service
+func routed(exposure ExposureSpec) bool {
+	return exposure.Type == ExposureTypeIngress || exposure.Type == ExposureTypeHTTPRoute
+}
+
+// verifyBundleUrl fetches the first bytes of the bundle and checks they are
+// the ones of a zip archive.
+func verifyBundleUrl(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=0-%d", len(zipMagic)-1))
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("bundle is unreachable: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("bundle is unreachable: %s", response.Status)
+	}
+
+	magic := make([]byte, len(zipMagic))
+	if _, err := io.ReadFull(response.Body, magic); err != nil || !bytes.Equal(magic, zipMagic) {
+		return fmt.Errorf("bundle is not a zip archive")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GameCatalogSource is where the index of a GameCatalog is read from. Exactly
+// one of url, configMapRef and oci must be set.
+type GameCatalogSource struct {
+	// Url is the http(s) address of the index, a JSON or YAML document
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^https?:\/\/(?:www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b(?:[-a-zA-Z0-9()@:%_\+.~#?&\/=]*)$`
+	Url string `json:"url,omitempty"`
+
+	// ConfigMapRef selects the key of a configmap in the namespace of the
+	// catalog holding the index
+	// +optional
+	ConfigMapRef *corev1.ConfigMapKeySelector `json:"configMapRef,omitempty"`
+
+	// Oci is the reference of an OCI artifact holding the index as its first
+	// layer, such as registry.local/catalogs/dos:latest. Append
+	// @sha256:<digest> to pull it by digest.
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?::[0-9]+)?(?:\/[a-z0-9]+(?:[._-][a-z0-9]+)*)+(?::[\w][\w.-]{0,127})?(?:@sha256:[a-f0-9]{64})?$`
+	Oci string `json:"oci,omitempty"`
+
+	// CredentialsSecretRef names a secret in the namespace of the catalog with
+	// the credentials the index is read with, holding the same keys as the
+	// credentials of a bundle. The username and password are used to log in
+	// to the registry of an oci index.
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// GameCatalogSpec defines the desired state of GameCatalog
+type GameCatalogSpec struct {
+	// Source of the index listing the games of the catalog
+	// +kubebuilder:validation:Required
+	Source GameCatalogSource `json:"source"`
+
+	// Interval the index is read again at
+	// +optional
+	// +kubebuilder:default:="1h"
+	Interval metav1.Duration `json:"interval,omitempty"`
+
+	// Prune deletes the games of the catalog that are no longer listed in its
+	// index. Deployed games are never pruned.
+	// +optional
+	// +kubebuilder:default:=true
+	Prune *bool `json:"prune,omitempty"`
+}
+
+const (
+	// ConditionCatalogSynced reports whether the games of the catalog match
+	// its index
+	ConditionCatalogSynced = "Synced"
+)
+
+// GameCatalogStatus defines the observed state of GameCatalog
+type GameCatalogStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// LastSyncTime is when the index was last read
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Revision is the sha256 of the index last synced
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// Games is the number of games materialized from the index
+	// +optional
+	Games int `json:"games,omitempty"`
+
+	// Conflicts are the games of the index skipped because a game of the same
+	// name, not materialized by the catalog, exists already
+	// +optional
+	Conflicts []string `json:"conflicts,omitempty"`
+
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// GameCatalog is the Schema for the gamecatalogs API. It materializes a Game,
+// not deployed, for every entry of an index, and prunes the games removed
+// from it.
+// +kubebuilder:printcolumn:name="Games",type=integer,JSONPath=`.status.games`
+// +kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+// +kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type GameCatalog struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GameCatalogSpec   `json:"spec,omitempty"`
+	Status GameCatalogStatus `json:"status,omitempty"`
+}
+
+// Prunes reports whether the games removed from the index are deleted
+func (c *GameCatalog) Prunes() bool {
+	return c.Spec.Prune == nil || *c.Spec.Prune
+}
+
+//+kubebuilder:object:root=true
+
+// GameCatalogList contains a list of GameCatalog
+type GameCatalogList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GameCatalog `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GameCatalog{}, &GameCatalogList{})
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSessionTTL is how long a session lasts unless it sets spec.ttl
+	DefaultSessionTTL = 2 * time.Hour
+)
+
+// GameSessionSpec defines the desired state of GameSession
+type GameSessionSpec struct {
+	// Player the session is for, such as a user name or an email address,
+	// made of letters, digits and ._@+- the way the save service names players
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength:=1
+	// +kubebuilder:validation:MaxLength:=128
+	// +kubebuilder:validation:Pattern:=`^[A-Za-z0-9][A-Za-z0-9._@+-]*$`
+	Player string `json:"player"`
+
+	// GameRef names the Game, in the namespace of the session, the session
+	// runs an instance of
+	// +kubebuilder:validation:Required
+	GameRef corev1.LocalObjectReference `json:"gameRef"`
+
+	// TTL is how long the session lasts from its creation. An expired session
+	// is deleted, along with its instance and its save volume.
+	// +optional
+	// +kubebuilder:default:="2h"
+	TTL metav1.Duration `json:"ttl,omitempty"`
+}
+
+const (
+	// ConditionSessionReady reports whether the instance of the session is
+	// ready to be played
+	ConditionSessionReady = "Ready"
+)
+
+// GameSessionStatus defines the observed state of GameSession
+type GameSessionStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// +optional
+	Phase GamePhase `json:"phase,omitempty"`
+
+	// Endpoint is the in-cluster address of the service of the instance
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// URL is the address the player opens the session at, exposed the way
+	// its game is. Empty until the address is known.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// ExpiresAt is when the session is deleted
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// GameSession is the Schema for the gamesessions API. It runs an instance of
+// a Game for a single player, with a save volume and a URL of its own, until
+// its ttl runs out.
+// +kubebuilder:printcolumn:name="Player",type=string,JSONPath=`.spec.player`
+// +kubebuilder:printcolumn:name="Game",type=string,JSONPath=`.spec.gameRef.name`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`
+// +kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.status.expiresAt`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type GameSession struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GameSessionSpec   `json:"spec,omitempty"`
+	Status GameSessionStatus `json:"status,omitempty"`
+}
+
+// ExpiresAt is when the session runs out, its ttl after its creation
+func (s *GameSession) ExpiresAt() metav1.Time {
+	ttl := s.Spec.TTL.Duration
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	return metav1.NewTime(s.CreationTimestamp.Add(ttl))
+}
+
+// InstanceName is the name of the resources of the instance of the session,
+// the name of its game and its own. Names too long for a service are cut
+// short and told apart by a hash of the whole name.
+func (s *GameSession) InstanceName() string {
+	name := s.Spec.GameRef.Name + "-" + s.Name
+	if len(name) <= 63 {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	return strings.TrimRight(name[:54], "-.") + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+//+kubebuilder:object:root=true
+
+// GameSessionList contains a list of GameSession
+type GameSessionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GameSession `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GameSession{}, &GameSessionList{})
+}
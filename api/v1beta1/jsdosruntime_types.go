@@ -0,0 +1,140 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// JsDosRuntimeSpec defines the desired state of JsDosRuntime
+type JsDosRuntimeSpec struct {
+	// Version of js-dos
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern:=`^[0-9A-Za-z][0-9A-Za-z.+-]*$`
+	Version string `json:"version"`
+
+	// Url is the address the files of the version are downloaded from, with
+	// {version} standing in for the version. Defaults to the --js-dos-url of
+	// the manager.
+	// +optional
+	// +kubebuilder:validation:Pattern:=`^https?:\/\/`
+	Url string `json:"url,omitempty"`
+
+	// StorageClassName is the storage class of the claims the emulator assets
+	// are kept on, one per namespace with games running on the runtime
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes of the claims the emulator assets are kept on. The claims are
+	// mounted read-only by every game of the namespace, wherever they run.
+	// +optional
+	// +kubebuilder:default:={ReadWriteMany}
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// Size of the claims the emulator assets are kept on
+	// +optional
+	// +kubebuilder:default:="64Mi"
+	Size resource.Quantity `json:"size,omitempty"`
+}
+
+// JsDosRuntimeNamespace is the state of the emulator assets in a namespace
+type JsDosRuntimeNamespace struct {
+	// Namespace with games running on the runtime
+	Namespace string `json:"namespace"`
+
+	// Ready reports whether the emulator assets are in place
+	Ready bool `json:"ready"`
+
+	// Reason is why the emulator assets are not ready
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	// ConditionRuntimeReady reports whether the emulator assets are in place in
+	// every namespace with games running on the runtime
+	ConditionRuntimeReady = "Ready"
+)
+
+// JsDosRuntimeStatus defines the observed state of JsDosRuntime
+type JsDosRuntimeStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Namespaces are the namespaces with games running on the runtime
+	// +optional
+	// +listType=map
+	// +listMapKey=namespace
+	Namespaces []JsDosRuntimeNamespace `json:"namespaces,omitempty"`
+
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster,shortName=jsdos
+
+// JsDosRuntime is the Schema for the jsdosruntimes API. It owns the js-dos
+// emulator assets of the games referencing it, populating them once per
+// namespace with a job.
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.version`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type JsDosRuntime struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   JsDosRuntimeSpec   `json:"spec,omitempty"`
+	Status JsDosRuntimeStatus `json:"status,omitempty"`
+}
+
+// NamespaceReady reports whether the emulator assets of the current spec are
+// in place in the namespace
+func (r *JsDosRuntime) NamespaceReady(namespace string) bool {
+	if r.Status.ObservedGeneration != r.Generation {
+		return false
+	}
+
+	for _, status := range r.Status.Namespaces {
+		if status.Namespace == namespace {
+			return status.Ready
+		}
+	}
+
+	return false
+}
+
+//+kubebuilder:object:root=true
+
+// JsDosRuntimeList contains a list of JsDosRuntime
+type JsDosRuntimeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []JsDosRuntime `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&JsDosRuntime{}, &JsDosRuntimeList{})
+}
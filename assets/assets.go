@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"embed"
 	"fmt"
+	htmltemplate "html/template"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -32,6 +37,14 @@ func init() {
 	if err := corev1.AddToScheme(appsScheme); err != nil {
 		panic(err)
 	}
+
+	if err := batchv1.AddToScheme(appsScheme); err != nil {
+		panic(err)
+	}
+
+	if err := networkingv1.AddToScheme(appsScheme); err != nil {
+		panic(err)
+	}
 }
 
 func getTemplate(name string) (*template.Template, error) {
@@ -65,62 +78,208 @@ func getObject(name string, gv schema.GroupVersion, metadata any) (runtime.Objec
 		appsCodecs.UniversalDecoder(gv),
 		buffer.Bytes(),
 	)
+	if err != nil {
+		return nil, err
+	}
 
 	return object, nil
 }
 
-func GetDeployment(namespace string, name string, port int, bundleUrl string) (*appsv1.Deployment, error) {
-	metadata := struct {
-		Namespace string
-		Name      string
-		Port      int
-		BundleUrl string
-	}{
-		Namespace: namespace,
-		Name:      name,
-		Port:      port,
-		BundleUrl: bundleUrl,
+// DeploymentParameters are the values the deployment of a game is rendered with
+type DeploymentParameters struct {
+	Namespace string
+	Name      string
+	Port      int
+	// Bundle is the file name the bundle is stored under
+	Bundle string
+	// BundleUrl is where the init container downloads the bundle from
+	BundleUrl string
+	// BundleOci is the artifact the init container pulls the bundle from,
+	// when there is no BundleUrl
+	BundleOci string
+	// BundleConfigMap, BundleSecret or BundleClaim is the in-cluster volume
+	// the init container copies the bundle at BundlePath from, when there is
+	// neither a BundleUrl nor a BundleOci
+	BundleConfigMap string
+	BundleSecret    string
+	BundleClaim     string
+	BundlePath      string
+	// BundleSha256 is the digest the bundle is checked against, if not empty
+	BundleSha256 string
+	// CredentialsSecret is the secret holding the http headers the bundle is
+	// downloaded with, if not empty
+	CredentialsSecret string
+	RedeployedAt      string
+	// BundleRevision identifies the bundle and the redeployment it was
+	// downloaded for. A pod finding the bundle of the same revision on the
+	// claim, as one resuming a suspended game does, skips the download. Bundles
+	// of in-cluster volumes are copied every time.
+	BundleRevision string
+	// RuntimeVersion is the js-dos version the game runs on
+	RuntimeVersion string
+	// RuntimeUrl is where the init container downloads that js-dos version
+	// from, if not empty. Without it the assets are expected on AssetsClaim.
+	RuntimeUrl string
+	// AssetsClaim is the claim holding the emulator assets
+	AssetsClaim string
+	// Path is the path the game is served under, ending with a slash
+	Path string
+	// IndexChecksum is the digest of the page of the game, rolling out a new
+	// pod when the page changes
+	IndexChecksum string
+	// Stopped scales the deployment down to no pods
+	Stopped bool
+	// EmptyDir keeps the files of the game in an emptyDir instead of its
+	// claim, limited to EmptyDirSizeLimit if set
+	EmptyDir          bool
+	EmptyDirSizeLimit string
+	// Resources are set on the engine container
+	Resources corev1.ResourceRequirements
+	// SavesImage is the image the save service of the game runs from, which
+	// listens at SavesPort on localhost and keeps the saves of its players,
+	// up to SavesQuota bytes. It keeps those of SavesPlayer only if set. The
+	// game has no save service if empty.
+	SavesImage  string
+	SavesPort   int
+	SavesPlayer string
+	SavesQuota  int64
+	// StatusPort is the port the engine reports its request counts at, zero
+	// if it does not
+	StatusPort int
+}
+
+func GetDeployment(parameters DeploymentParameters) (*appsv1.Deployment, error) {
+	object, err := getObject("deployment", appsv1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
 	}
 
-	object, err := getObject("deployment", appsv1.SchemeGroupVersion, metadata)
+	deployment := object.(*appsv1.Deployment)
+	for i, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == fmt.Sprintf("%s-engine", parameters.Name) {
+			deployment.Spec.Template.Spec.Containers[i].Resources = parameters.Resources
+		}
+	}
+
+	return deployment, nil
+}
+
+// ServiceParameters are the values the service of a game is rendered with
+type ServiceParameters struct {
+	Namespace string
+	Name      string
+	Port      int
+	Type      corev1.ServiceType
+	// NodePort is left to the cluster to pick if zero
+	NodePort int32
+	// Activator leaves the selector out, the endpoints of the service point
+	// at the activator instead of the pods of the game
+	Activator bool
+}
+
+func GetService(parameters ServiceParameters) (*corev1.Service, error) {
+	object, err := getObject("service", corev1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	return object.(*appsv1.Deployment), nil
+	return object.(*corev1.Service), nil
 }
 
-func GetService(namespace string, name string, port int) (*corev1.Service, error) {
-	metadata := struct {
-		Namespace string
-		Name      string
-		Port      int
-	}{
-		Namespace: namespace,
-		Name:      name,
-		Port:      port,
+// EndpointsParameters are the values the endpoints sending the requests of a
+// game to the activator are rendered with
+type EndpointsParameters struct {
+	Namespace string
+	Name      string
+	Ip        string
+	Port      int32
+}
+
+func GetEndpoints(parameters EndpointsParameters) (*corev1.Endpoints, error) {
+	object, err := getObject("endpoints", corev1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
 	}
 
-	object, err := getObject("service", corev1.SchemeGroupVersion, metadata)
+	return object.(*corev1.Endpoints), nil
+}
+
+// RouteParameters are the values the Ingress or the HTTPRoute of a game is
+// rendered with
+type RouteParameters struct {
+	Namespace string
+	Name      string
+	// Port is the port of the service of the game the route forwards to
+	Port int
+	Host string
+	Path string
+	// ClassName, TLSSecretName and Annotations only apply to an Ingress
+	ClassName     string
+	TLSSecretName string
+	Annotations   map[string]string
+	// ParentRefs only apply to an HTTPRoute
+	ParentRefs []ParentReference
+}
+
+// ParentReference is a listener of a Gateway an HTTPRoute attaches to
+type ParentReference struct {
+	Name        string
+	Namespace   string
+	SectionName string
+}
+
+func GetIngress(parameters RouteParameters) (*networkingv1.Ingress, error) {
+	object, err := getObject("ingress", networkingv1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	return object.(*corev1.Service), nil
+	return object.(*networkingv1.Ingress), nil
 }
 
-func GetPersistentVolumeClaim(namespace string, name string, storage uint64) (*corev1.PersistentVolumeClaim, error) {
-	metadata := struct {
-		Namespace string
-		Name      string
-		Storage   uint64
-	}{
-		Namespace: namespace,
-		Name:      name,
-		Storage:   storage,
+// GetHTTPRoute renders the HTTPRoute of a game. It is unstructured, so that
+// the operator does not depend on the Gateway API being installed.
+func GetHTTPRoute(parameters RouteParameters) (*unstructured.Unstructured, error) {
+	parse, err := getTemplate("httproute")
+	if err != nil {
+		return nil, err
 	}
 
-	object, err := getObject("pvc", corev1.SchemeGroupVersion, metadata)
+	var buffer bytes.Buffer
+	err = parse.Execute(&buffer, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.YAMLToJSON(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	route := &unstructured.Unstructured{}
+	err = route.UnmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return route, nil
+}
+
+// PersistentVolumeClaimParameters are the values the claim of a game is rendered with
+type PersistentVolumeClaimParameters struct {
+	Namespace string
+	Name      string
+	// Storage is the size of the claim in MiB
+	Storage uint64
+	// StorageClassName, AccessModes and VolumeMode are left to the defaults
+	// of the cluster if empty
+	StorageClassName string
+	AccessModes      []corev1.PersistentVolumeAccessMode
+	VolumeMode       corev1.PersistentVolumeMode
+}
+
+func GetPersistentVolumeClaim(parameters PersistentVolumeClaimParameters) (*corev1.PersistentVolumeClaim, error) {
+	object, err := getObject("pvc", corev1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
@@ -147,18 +306,108 @@ func GetPersistentVolumeClaimAssets(namespace string, name string, storage uint6
 	return object.(*corev1.PersistentVolumeClaim), nil
 }
 
-func GetConfigMap(namespace string, name string, bundle string) (*corev1.ConfigMap, error) {
-	metadata := struct {
-		Namespace string
-		Name      string
-		Bundle    string
-	}{
-		Namespace: namespace,
-		Name:      name,
-		Bundle:    bundle,
+// RuntimeParameters are the values the claim and the job populating the
+// emulator assets of a JsDosRuntime in a namespace are rendered with
+type RuntimeParameters struct {
+	Namespace string
+	Name      string
+	Version   string
+	// Url is where the job downloads the files of the version from
+	Url              string
+	StorageClassName string
+	AccessModes      []corev1.PersistentVolumeAccessMode
+	Storage          string
+}
+
+func GetRuntimePersistentVolumeClaim(parameters RuntimeParameters) (*corev1.PersistentVolumeClaim, error) {
+	object, err := getObject("pvc-runtime", corev1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
 	}
 
-	object, err := getObject("configmap", corev1.SchemeGroupVersion, metadata)
+	return object.(*corev1.PersistentVolumeClaim), nil
+}
+
+func GetRuntimeJob(parameters RuntimeParameters) (*batchv1.Job, error) {
+	object, err := getObject("job-runtime", batchv1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return object.(*batchv1.Job), nil
+}
+
+// MigrationParameters are the values a job copying the files of a game from
+// one claim to another is rendered with
+type MigrationParameters struct {
+	Namespace string
+	Name      string
+	// Step names the job along with the game
+	Step string
+	From string
+	To   string
+}
+
+func GetMigrationJob(parameters MigrationParameters) (*batchv1.Job, error) {
+	object, err := getObject("job-migration", batchv1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return object.(*batchv1.Job), nil
+}
+
+// GetVerifyJob renders the job checking the bundle of a game against its
+// digest before the game is rolled out. It downloads, pulls or copies the
+// bundle the way the init container of the deployment does.
+func GetVerifyJob(parameters DeploymentParameters) (*batchv1.Job, error) {
+	object, err := getObject("job-verify", batchv1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return object.(*batchv1.Job), nil
+}
+
+// ConfigMapParameters are the values the configmap holding the page of a game
+// is rendered with
+type ConfigMapParameters struct {
+	Namespace string
+	Name      string
+	// Bundle is the file name the bundle is stored under
+	Bundle string
+	// Path is the path the game is served under, ending with a slash, and
+	// PathPrefix the same path without it
+	Path       string
+	PathPrefix string
+	// Title, Description and ThumbnailUrl end up in the title and the Open
+	// Graph tags of the page. They must fit on a single line.
+	Title        string
+	Description  string
+	ThumbnailUrl string
+	// Byline is shown under the title in the controls overlay, such as the
+	// publisher, the year and the genre
+	Byline string
+	// Controls are listed in an overlay of the page, if any
+	Controls []Control
+	// SavesPort is the port the save service of the game listens at on
+	// localhost, zero if the game has none. The page then keeps the saves of
+	// its player on the service, Player if set.
+	SavesPort int
+	Player    string
+	// StatusPort is the port nginx reports its request counts at, zero if it
+	// does not
+	StatusPort int
+}
+
+// Control is a key a game is played with
+type Control struct {
+	Keys   string
+	Action string
+}
+
+func GetConfigMap(parameters ConfigMapParameters) (*corev1.ConfigMap, error) {
+	object, err := getObject("configmap", corev1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
@@ -166,26 +415,97 @@ func GetConfigMap(namespace string, name string, bundle string) (*corev1.ConfigM
 	return object.(*corev1.ConfigMap), nil
 }
 
-func GetIndex(bundle string) ([]byte, error) {
-	staticBytes, err := static.ReadFile("static/index.html")
+// ArcadeParameters are the values the objects of the arcade are rendered with
+type ArcadeParameters struct {
+	Namespace string
+	Name      string
+	// Port is the port of the service of the arcade
+	Port int
+}
+
+// IndexParameters are the values the landing page of the arcade is rendered with
+type IndexParameters struct {
+	Title string
+	Games []IndexGame
+	// Omitted counts the games left out of the page for lack of room
+	Omitted int
+}
+
+// IndexGame is a game listed on the landing page of the arcade
+type IndexGame struct {
+	Namespace string
+	Name      string
+	Title     string
+	// Byline, Description and ThumbnailUrl are empty for games without them
+	Byline       string
+	Description  string
+	ThumbnailUrl string
+	// Url is where the game is played, empty while it is not reachable
+	Url   string
+	Ready bool
+	// Phase is empty for games that are not deployed
+	Phase string
+}
+
+func GetArcadeDeployment(parameters ArcadeParameters) (*appsv1.Deployment, error) {
+	object, err := getObject("deployment-arcade", appsv1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	tmp := template.New("index")
-	parse, err := tmp.Parse(string(staticBytes))
+	return object.(*appsv1.Deployment), nil
+}
+
+func GetArcadeService(parameters ArcadeParameters) (*corev1.Service, error) {
+	object, err := getObject("service-arcade", corev1.SchemeGroupVersion, parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	metadata := struct {
-		Bundle string
-	}{
-		Bundle: bundle,
+	return object.(*corev1.Service), nil
+}
+
+// GetArcadeConfigMap renders the configmap serving the landing page of the
+// arcade, listing the given games
+func GetArcadeConfigMap(parameters ArcadeParameters, index IndexParameters) (*corev1.ConfigMap, error) {
+	object, err := getObject("configmap-arcade", corev1.SchemeGroupVersion, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := GetIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	favicon, err := static.ReadFile("static/favicon.ico")
+	if err != nil {
+		return nil, err
+	}
+
+	cmap := object.(*corev1.ConfigMap)
+	cmap.Data = map[string]string{"index.html": string(page)}
+	cmap.BinaryData = map[string][]byte{"favicon.ico": favicon}
+
+	return cmap, nil
+}
+
+// GetIndex renders the landing page of the arcade. Everything on it comes
+// from games, so it is escaped as html.
+func GetIndex(parameters IndexParameters) ([]byte, error) {
+	staticBytes, err := static.ReadFile("static/index.html")
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := htmltemplate.New("index")
+	parse, err := tmp.Parse(string(staticBytes))
+	if err != nil {
+		return nil, err
 	}
 
 	var buffer bytes.Buffer
-	err = parse.Execute(&buffer, metadata)
+	err = parse.Execute(&buffer, parameters)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,81 @@
+package assets
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	//go:embed runtime
+	runtimeFiles embed.FS
+)
+
+// GetRuntimeVersions returns the js-dos versions embedded into the manager
+func GetRuntimeVersions() ([]string, error) {
+	entries, err := runtimeFiles.ReadDir("runtime")
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+
+	return versions, nil
+}
+
+// RuntimeServer serves the embedded js-dos versions at /js-dos/<version>/<file>
+type RuntimeServer struct {
+	Addr string
+}
+
+// Start implements manager.Runnable
+func (s *RuntimeServer) Start(ctx context.Context) error {
+	versions, err := fs.Sub(runtimeFiles, "runtime")
+	if err != nil {
+		return err
+	}
+
+	files := http.StripPrefix("/js-dos/", http.FileServer(http.FS(versions)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/js-dos/", func(w http.ResponseWriter, r *http.Request) {
+		// only the files of a version are served, no listings
+		if strings.HasSuffix(r.URL.Path, "/") || strings.Count(strings.TrimPrefix(r.URL.Path, "/js-dos/"), "/") != 1 {
+			http.NotFound(w, r)
+			return
+		}
+
+		files.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica
+// of the manager serves the runtime
+func (s *RuntimeServer) NeedLeaderElection() bool {
+	return false
+}
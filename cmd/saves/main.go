@@ -0,0 +1,86 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"github.com/akyriako/kube-dosbox/saves"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"os"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func main() {
+	var addr string
+	var root string
+	var keyFile string
+	var maxSize string
+	var player string
+	var quota string
+	flag.StringVar(&addr, "bind-address", "127.0.0.1:8090", "The address the save service listens at.")
+	flag.StringVar(&root, "root", "/mnt/game/.saves", "The directory the saves of the players are kept under.")
+	flag.StringVar(&keyFile, "key-file", "/mnt/game/.saves/.key",
+		"The file with the key the tokens of the players are signed with, created with a random key if missing.")
+	flag.StringVar(&maxSize, "max-size", "64Mi", "The largest save stored.")
+	flag.StringVar(&player, "player", "", "The only player whose saves are kept. Leave it empty to keep the saves of any player.")
+	flag.StringVar(&quota, "quota", "0", "How much all saves together may take. Set it to 0 for no limit.")
+	opts := zap.Options{
+		Development:     true,
+		StacktraceLevel: zapcore.DPanicLevel,
+	}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	log := ctrl.Log.WithName("saves")
+
+	size, err := resource.ParseQuantity(maxSize)
+	if err != nil {
+		log.Error(err, "unable to parse --max-size")
+		os.Exit(1)
+	}
+
+	limit, err := resource.ParseQuantity(quota)
+	if err != nil {
+		log.Error(err, "unable to parse --quota")
+		os.Exit(1)
+	}
+
+	key, err := saves.LoadKey(keyFile)
+	if err != nil {
+		log.Error(err, "unable to load --key-file")
+		os.Exit(1)
+	}
+
+	server := &saves.Server{
+		Addr:    addr,
+		Root:    root,
+		Key:     key,
+		MaxSize: size.Value(),
+		Player:  player,
+		Quota:   limit.Value(),
+		Log:     log,
+	}
+
+	log.Info("serving saves", "address", addr, "root", root)
+	if err := server.Start(ctrl.SetupSignalHandler()); err != nil {
+		log.Error(err, "problem running save service")
+		os.Exit(1)
+	}
+}
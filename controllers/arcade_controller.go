@@ -0,0 +1,296 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+)
+
+const (
+	// arcadeName names the deployment, the service and the configmap of the arcade
+	arcadeName = "kube-dosbox-arcade"
+	// arcadePort is the port of the service of the arcade
+	arcadePort = 80
+	// arcadeTitle is the title of the landing page of the arcade
+	arcadeTitle = "kube-dosbox arcade"
+	// arcadeDescriptionLength is how many characters of the description of a
+	// game the arcade shows
+	arcadeDescriptionLength = 280
+	// arcadeConfigMapLimit is how many bytes of data the configmap of the
+	// arcade holds at most, leaving room for its metadata within the 1MiB an
+	// object may take
+	arcadeConfigMapLimit = 1000 * 1024
+)
+
+// ArcadeReconciler runs the arcade, a landing page listing every Game of the
+// cluster. There is a single arcade, so every game maps to the same request.
+type ArcadeReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Namespace is where the arcade runs
+	Namespace string
+}
+
+// Reconcile renders the landing page of the arcade from the games of the
+// cluster, and makes sure the arcade serves it. The page is mounted without a
+// subPath, so the arcade picks up a new one without its pod being replaced.
+func (r *ArcadeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithName("arcade")
+
+	games := &operatorv1beta1.GameList{}
+	if err := r.List(ctx, games); err != nil {
+		log.V(5).Error(err, "unable to list games")
+		return ctrl.Result{}, err
+	}
+
+	parameters := assets.ArcadeParameters{
+		Namespace: r.Namespace,
+		Name:      arcadeName,
+		Port:      arcadePort,
+	}
+
+	desiredConfigMap, omitted, err := arcadeConfigMap(parameters, arcadeIndex(games.Items), arcadeConfigMapLimit)
+	if err != nil {
+		log.Error(err, "unable to parse arcade configmap template")
+		return ctrl.Result{}, err
+	}
+
+	if omitted > 0 {
+		log.Info("arcade does not list every game, they do not fit its configmap", "games", len(games.Items), "omitted", omitted)
+	}
+
+	cmap := &corev1.ConfigMap{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(desiredConfigMap), cmap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.V(5).Error(err, "unable to fetch arcade configmap")
+		return ctrl.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) ||
+		!equality.Semantic.DeepEqual(desiredConfigMap.Data, cmap.Data) ||
+		!equality.Semantic.DeepEqual(desiredConfigMap.BinaryData, cmap.BinaryData) {
+		if err := r.apply(ctx, desiredConfigMap); err != nil {
+			log.Error(err, "unable to apply arcade configmap")
+			return ctrl.Result{}, err
+		}
+	}
+
+	desiredDeployment, err := assets.GetArcadeDeployment(parameters)
+	if err != nil {
+		log.Error(err, "unable to parse arcade deployment template")
+		return ctrl.Result{}, err
+	}
+
+	deployment := &appsv1.Deployment{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(desiredDeployment), deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.V(5).Error(err, "unable to fetch arcade deployment")
+		return ctrl.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) || drifted(desiredDeployment, deployment, desiredDeployment.Spec, deployment.Spec) {
+		if err := r.apply(ctx, desiredDeployment); err != nil {
+			log.Error(err, "unable to apply arcade deployment")
+			return ctrl.Result{}, err
+		}
+	}
+
+	desiredService, err := assets.GetArcadeService(parameters)
+	if err != nil {
+		log.Error(err, "unable to parse arcade service template")
+		return ctrl.Result{}, err
+	}
+
+	svc := &corev1.Service{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(desiredService), svc)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.V(5).Error(err, "unable to fetch arcade service")
+		return ctrl.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) || drifted(desiredService, svc, desiredService.Spec, svc.Spec) {
+		if err := r.apply(ctx, desiredService); err != nil {
+			log.Error(err, "unable to apply arcade service")
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *ArcadeReconciler) apply(ctx context.Context, desired client.Object) error {
+	return r.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// arcadeIndex lists the games on the landing page of the arcade, sorted by
+// their title
+func arcadeIndex(games []operatorv1beta1.Game) assets.IndexParameters {
+	index := assets.IndexParameters{Title: arcadeTitle}
+
+	for _, game := range games {
+		if !game.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		description := []rune(game.Spec.Description)
+		if len(description) > arcadeDescriptionLength {
+			description = append(description[:arcadeDescriptionLength-1], '…')
+		}
+
+		entry := assets.IndexGame{
+			Namespace:    game.Namespace,
+			Name:         game.Name,
+			Title:        game.Spec.GameName,
+			Byline:       byline(&game),
+			Description:  string(description),
+			ThumbnailUrl: game.Spec.ThumbnailUrl,
+			Url:          game.Status.URL,
+			Ready:        game.Status.Ready != nil && *game.Status.Ready,
+		}
+
+		if game.Spec.Deploy {
+			entry.Phase = string(game.Status.Phase)
+		}
+
+		index.Games = append(index.Games, entry)
+	}
+
+	sort.SliceStable(index.Games, func(i, j int) bool {
+		if index.Games[i].Title != index.Games[j].Title {
+			return index.Games[i].Title < index.Games[j].Title
+		}
+
+		return index.Games[i].Namespace+"/"+index.Games[i].Name < index.Games[j].Namespace+"/"+index.Games[j].Name
+	})
+
+	return index
+}
+
+// arcadeConfigMap renders the configmap of the arcade. Games are left out from
+// the end of the index until its data fits in limit bytes, and the number of
+// games left out is returned along with it.
+func arcadeConfigMap(parameters assets.ArcadeParameters, index assets.IndexParameters, limit int) (*corev1.ConfigMap, int, error) {
+	games := index.Games
+
+	render := func(listed int) (*corev1.ConfigMap, bool, error) {
+		index.Games = games[:listed]
+		index.Omitted = len(games) - listed
+
+		cmap, err := assets.GetArcadeConfigMap(parameters, index)
+		if err != nil {
+			return nil, false, err
+		}
+
+		size := 0
+		for _, data := range cmap.Data {
+			size += len(data)
+		}
+		for _, data := range cmap.BinaryData {
+			size += len(data)
+		}
+
+		return cmap, size <= limit, nil
+	}
+
+	cmap, fits, err := render(len(games))
+	if err != nil || fits {
+		return cmap, 0, err
+	}
+
+	// look for the most games that fit, the page without any is assumed to fit
+	fewest, most := 0, len(games)
+	for most-fewest > 1 {
+		listed := (fewest + most) / 2
+
+		_, fits, err := render(listed)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if fits {
+			fewest = listed
+		} else {
+			most = listed
+		}
+	}
+
+	cmap, _, err = render(fewest)
+	return cmap, len(games) - fewest, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ArcadeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	arcade := metav1.ObjectMeta{Namespace: r.Namespace, Name: arcadeName}
+
+	// the arcade is rendered once on start, before any game changes
+	start := make(chan event.GenericEvent, 1)
+	start <- event.GenericEvent{Object: &corev1.ConfigMap{ObjectMeta: arcade}}
+
+	arcadeEventFilters := builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == arcade.Namespace && object.GetName() == arcade.Name
+	}))
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("arcade").
+		Watches(
+			&source.Channel{Source: start},
+			&handler.EnqueueRequestForObject{},
+		).
+		Watches(
+			&source.Kind{Type: &operatorv1beta1.Game{}},
+			handler.EnqueueRequestsFromMapFunc(r.arcadeForGame),
+		).
+		Watches(
+			&source.Kind{Type: &appsv1.Deployment{}},
+			&handler.EnqueueRequestForObject{},
+			arcadeEventFilters,
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Service{}},
+			&handler.EnqueueRequestForObject{},
+			arcadeEventFilters,
+		).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			&handler.EnqueueRequestForObject{},
+			arcadeEventFilters,
+		).
+		Complete(r)
+}
+
+// arcadeForGame maps any change of a game, its status included, to the arcade
+func (r *ArcadeReconciler) arcadeForGame(object client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: r.Namespace, Name: arcadeName}}}
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestArcadeIndex(t *testing.T) {
+	ready := true
+	now := metav1.Now()
+
+	games := []operatorv1beta1.Game{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "prince", Namespace: "arcade"},
+			Spec:       operatorv1beta1.GameSpec{GameName: "Prince of Persia"},
+			Status:     operatorv1beta1.GameStatus{Phase: operatorv1beta1.GamePhaseUndeployed},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+			Spec: operatorv1beta1.GameSpec{
+				GameName:  "<Doom>",
+				Deploy:    true,
+				Publisher: "id Software",
+				Year:      1993,
+			},
+			Status: operatorv1beta1.GameStatus{
+				Ready: &ready,
+				Phase: operatorv1beta1.GamePhaseRunning,
+				URL:   "https://arcade.example.com/doom/",
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "keen", Namespace: "arcade", DeletionTimestamp: &now},
+			Spec:       operatorv1beta1.GameSpec{GameName: "Commander Keen", Deploy: true},
+		},
+	}
+
+	index := arcadeIndex(games)
+
+	want := []assets.IndexGame{
+		{Namespace: "arcade", Name: "doom", Title: "<Doom>", Byline: "id Software, 1993", Url: "https://arcade.example.com/doom/", Ready: true, Phase: "Running"},
+		{Namespace: "arcade", Name: "prince", Title: "Prince of Persia"},
+	}
+
+	if len(index.Games) != len(want) {
+		t.Fatalf("arcade lists %+v, expected %+v", index.Games, want)
+	}
+
+	for i := range want {
+		if index.Games[i] != want[i] {
+			t.Errorf("arcade lists %+v, expected %+v", index.Games[i], want[i])
+		}
+	}
+
+	page, err := assets.GetIndex(index)
+	if err != nil {
+		t.Fatalf("rendering index: %v", err)
+	}
+
+	if !strings.Contains(string(page), `<a href="https://arcade.example.com/doom/">&lt;Doom&gt;</a>`) {
+		t.Errorf("index does not link the escaped title of the game:\n%s", page)
+	}
+}
+
+func TestArcadeConfigMapLimit(t *testing.T) {
+	var games []operatorv1beta1.Game
+	for i := 0; i < 50; i++ {
+		games = append(games, operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("game-%02d", i), Namespace: "arcade"},
+			Spec: operatorv1beta1.GameSpec{
+				GameName:    fmt.Sprintf("Game %02d", i),
+				Description: strings.Repeat("a", 1024),
+			},
+		})
+	}
+
+	index := arcadeIndex(games)
+	for _, game := range index.Games {
+		if description := []rune(game.Description); len(description) != arcadeDescriptionLength || description[len(description)-1] != '…' {
+			t.Fatalf("arcade shows the description %q in full", game.Description)
+		}
+	}
+
+	parameters := assets.ArcadeParameters{Namespace: "kube-dosbox", Name: arcadeName, Port: arcadePort}
+
+	cmap, omitted, err := arcadeConfigMap(parameters, index, arcadeConfigMapLimit)
+	if err != nil || omitted != 0 {
+		t.Fatalf("arcade omitted %d games, %v", omitted, err)
+	}
+
+	limit := len(cmap.Data["index.html"]) + len(cmap.BinaryData["favicon.ico"]) - 5000
+
+	cmap, omitted, err = arcadeConfigMap(parameters, index, limit)
+	if err != nil {
+		t.Fatalf("rendering arcade: %v", err)
+	}
+
+	page := cmap.Data["index.html"]
+	if omitted == 0 || len(page)+len(cmap.BinaryData["favicon.ico"]) > limit {
+		t.Fatalf("arcade of %d bytes does not fit in %d bytes, omitted %d games", len(page)+len(cmap.BinaryData["favicon.ico"]), limit, omitted)
+	}
+
+	if strings.Contains(page, "game-49") || !strings.Contains(page, fmt.Sprintf("%d more games do not fit", omitted)) {
+		t.Errorf("arcade does not leave out the last games:\n%s", page)
+	}
+
+	listed := strings.Count(page, "arcade/game-")
+	if listed+omitted != len(games) {
+		t.Errorf("arcade lists %d games and omits %d of %d", listed, omitted, len(games))
+	}
+
+	// one more game would not have fit
+	index.Games = index.Games[:listed+1]
+	if _, more, _ := arcadeConfigMap(parameters, index, limit); more == 0 {
+		t.Errorf("arcade left out games that fit")
+	}
+}
@@ -18,16 +18,28 @@ package controllers
 
 import (
 	"context"
-	operatorv1alpha1 "github.com/akyriako/kube-dosbox/api/v1alpha1"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
 	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
 )
 
 var (
@@ -41,7 +53,13 @@ var (
 			// updated on spec changes. On the other hand RevisionVersion
 			// changes also on status changes. We want to omit reconciliation
 			// for status updates.
-			return e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration()
+			//
+			// The redeploy-at annotation is the exception, as it does not
+			// bump the generation but asks for a new rollout. Games being
+			// deleted are always let through as well, so the finalizer runs.
+			return e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration() ||
+				e.ObjectOld.GetAnnotations()[redeployAtAnnotation] != e.ObjectNew.GetAnnotations()[redeployAtAnnotation] ||
+				e.ObjectNew.GetDeletionTimestamp() != nil
 		},
 		DeleteFunc: func(e event.DeleteEvent) bool {
 			// DeleteStateUnknown evaluates to false only if the object
@@ -50,7 +68,7 @@ var (
 		},
 		CreateFunc: func(e event.CreateEvent) bool {
 			switch object := e.Object.(type) {
-			case *operatorv1alpha1.Game:
+			case *operatorv1beta1.Game:
 				return object.Spec.Deploy
 			default:
 				return false
@@ -59,17 +77,58 @@ var (
 	})
 )
 
+var (
+	dependentEventFilters = builder.WithPredicates(predicate.GenerationChangedPredicate{})
+
+	podEventFilters = builder.WithPredicates(predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// Only readiness transitions of a pod are relevant for the status
+			// of a game, its containers restarting included.
+			oldPod, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+
+			newPod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+
+			return !equality.Semantic.DeepEqual(oldPod.Status.InitContainerStatuses, newPod.Status.InitContainerStatuses) ||
+				!equality.Semantic.DeepEqual(oldPod.Status.ContainerStatuses, newPod.Status.ContainerStatuses)
+		},
+	})
+)
+
 // GameReconciler reconciles a Game object
 type GameReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// RuntimeVersion is the js-dos version games run on, unless they set
+	// spec.runtime.version
+	RuntimeVersion string
+	// RuntimeUrl is where js-dos is downloaded from, with {version} standing
+	// in for the version a game runs on
+	RuntimeUrl string
+	// Sizer works out the size of the claims of games
+	Sizer StorageSizer
+	// Activator sits in front of the games with spec.idle, which are never
+	// scaled to zero without one
+	Activator *Activator
+	// SavesImage is the image the save service deployed alongside every game
+	// and game session runs from. They have no save service if empty.
+	SavesImage string
 }
 
 //+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=games,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=games/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=games/finalizers,verbs=update
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=jsdosruntimes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamesessions,verbs=get;list;watch
 //+kubebuilder:rbac:groups="apps",resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=configmaps;persistentvolumeclaims;services;pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=endpoints,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -83,7 +142,7 @@ type GameReconciler struct {
 func (r *GameReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger = log.FromContext(ctx).WithName("controller")
 
-	game := &operatorv1alpha1.Game{}
+	game := &operatorv1beta1.Game{}
 	if err := r.Get(ctx, req.NamespacedName, game); err != nil {
 		if apierrors.IsNotFound(err) {
 			return ctrl.Result{}, nil
@@ -97,23 +156,74 @@ func (r *GameReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 	//	//_ = r.SetStatus(ctx, req, game, false)
 	//}
 
+	if !game.DeletionTimestamp.IsZero() {
+		// the pods of the game going away trigger another reconciliation, so
+		// there is no need to requeue until Finalize is done
+		_, err := r.Finalize(ctx, req, game)
+		return ctrl.Result{}, err
+	}
+
+	// undeployed games get the finalizer as well, as they may be deployed
+	// and deleted again before the next reconciliation
+	if err := r.AddFinalizer(ctx, req, game); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	if !game.Spec.Deploy {
 		err := r.DeleteDeployment(ctx, req, game)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
 
-		_ = r.SetStatus(ctx, req, game, false)
+		_ = r.SetStatus(ctx, req, game, nil)
+
+		return ctrl.Result{}, nil
+	}
+
+	scheduled, err := r.Redeploy(ctx, req, game)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	verified, err := r.VerifyBundle(ctx, req, game)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !verified {
+		// a bundle is only rolled out once its digest is verified, until then
+		// the deployment is left alone and the game keeps serving whatever
+		// it served before
+		return ctrl.Result{}, nil
+	}
+
+	jsdos, assetsReady, err := r.ResolveRuntime(ctx, req, game)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
+	if !assetsReady {
+		// the runtime reconciles the game once it populated the namespace
 		return ctrl.Result{}, nil
 	}
 
-	_, err := r.CreateOrUpdatePersistentVolumeClaimAssets(ctx, req, game)
+	if jsdos == nil {
+		_, err = r.CreateOrUpdatePersistentVolumeClaimAssets(ctx, req, game)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	resizing, err := r.ResizeStorage(ctx, req, game)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	deployment, err := r.CreateOrUpdateDeployment(ctx, req, game)
+	// a game is stopped while its storage is recreated, while it is
+	// suspended, and while nobody plays it if it sets spec.idle
+	idle, idleIn := r.Idle(ctx, req, game)
+	stopped := resizing || idle || game.Spec.Suspend
+	deployment, err := r.CreateOrUpdateDeployment(ctx, req, game, jsdos, stopped)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -123,22 +233,180 @@ func (r *GameReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		return ctrl.Result{}, err
 	}
 
-	_, err = r.CreateOrUpdatePersistentVolumeClaim(ctx, req, game, deployment)
+	var pvc *corev1.PersistentVolumeClaim
+	if !resizing {
+		pvc, err = r.CreateOrUpdatePersistentVolumeClaim(ctx, req, game, deployment)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	svc, err := r.CreateOrUpdateService(ctx, req, game, deployment)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	err = r.CreateOrUpdateEndpoints(ctx, req, game, deployment, stopped)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ingress, err := r.CreateOrUpdateIngress(ctx, req, game, deployment)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	route, err := r.CreateOrUpdateHTTPRoute(ctx, req, game, deployment)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	_, err = r.CreateOrUpdateService(ctx, req, game, deployment)
+	url, err := r.GameUrl(ctx, game, svc, ingress, route)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return r.RefreshStatus(ctx, req, game, deployment.Labels["app"])
+	result, err := r.RefreshStatus(ctx, req, game, deployment, svc, pvc, url, idle)
+	for _, after := range []time.Duration{scheduled, idleIn} {
+		if after > 0 && (result.RequeueAfter == 0 || after < result.RequeueAfter) {
+			result.RequeueAfter = after
+		}
+	}
+
+	return result, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *GameReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&operatorv1alpha1.Game{}, gameEventFilters).
+	controller := ctrl.NewControllerManagedBy(mgr)
+
+	// the activator asks for games scaled to zero to be started again
+	if r.Activator != nil {
+		r.Activator.setup(r)
+		if err := mgr.Add(r.Activator); err != nil {
+			return err
+		}
+
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podIPField, podIP); err != nil {
+			return err
+		}
+
+		controller = controller.Watches(
+			&source.Channel{Source: r.Activator.wake},
+			&handler.EnqueueRequestForObject{},
+		)
+	}
+
+	// httproutes are only watched on clusters serving the gateway api, so
+	// the manager still starts on clusters without its crds
+	routes, err := servesHTTPRoutes(mgr.GetRESTMapper())
+	if err != nil {
+		return err
+	}
+
+	if routes {
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(httpRouteGVK)
+
+		controller = controller.Watches(
+			&source.Kind{Type: route},
+			handler.EnqueueRequestsFromMapFunc(r.gameForDependent),
+		)
+	}
+
+	return controller.
+		For(&operatorv1beta1.Game{}, gameEventFilters).
+		Owns(&appsv1.Deployment{}, dependentEventFilters).
+		Owns(&batchv1.Job{}).
+		Watches(
+			&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForDependent),
+		).
+		Watches(
+			&source.Kind{Type: &networkingv1.Ingress{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForDependent),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForDependent),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.PersistentVolumeClaim{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForDependent),
+		).
+		Watches(
+			&source.Kind{Type: &operatorv1beta1.JsDosRuntime{}},
+			handler.EnqueueRequestsFromMapFunc(r.gamesForRuntime),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForPod),
+			podEventFilters,
+		).
+		Watches(
+			&source.Kind{Type: &operatorv1beta1.GameSession{}},
+			handler.EnqueueRequestsFromMapFunc(r.gameForSession),
+		).
 		Complete(r)
 }
+
+// servesHTTPRoutes tells whether the cluster knows about the HTTPRoutes of
+// the gateway api.
+func servesHTTPRoutes(mapper meta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(httpRouteGVK.GroupKind(), httpRouteGVK.Version)
+	switch {
+	case err == nil:
+		return true, nil
+	case meta.IsNoMatchError(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// gameForDependent maps an object controlled by the deployment of a game back
+// to that game. Services, ingresses, configmaps and pvcs of a game are owned
+// by its deployment, which in turn shares the name of the game.
+func (r *GameReconciler) gameForDependent(object client.Object) []reconcile.Request {
+	owner := metav1.GetControllerOf(object)
+	if owner == nil || owner.Kind != "Deployment" || owner.APIVersion != appsv1.SchemeGroupVersion.String() {
+		return nil
+	}
+
+	return r.gameRequests(object.GetNamespace(), owner.Name)
+}
+
+// gameForPod maps a pod back to the game it is running, using the app label
+// the deployment template stamps on its pods.
+func (r *GameReconciler) gameForPod(object client.Object) []reconcile.Request {
+	return r.gameRequests(object.GetNamespace(), object.GetLabels()["app"])
+}
+
+// gameForSession maps a session to the game it runs an instance of, which
+// lists the session in its status
+func (r *GameReconciler) gameForSession(object client.Object) []reconcile.Request {
+	session, ok := object.(*operatorv1beta1.GameSession)
+	if !ok {
+		return nil
+	}
+
+	return r.gameRequests(session.Namespace, session.Spec.GameRef.Name)
+}
+
+func (r *GameReconciler) gameRequests(namespace string, name string) []reconcile.Request {
+	if name == "" {
+		return nil
+	}
+
+	objectKey := client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}
+
+	game := &operatorv1beta1.Game{}
+	if err := r.Get(context.Background(), objectKey, game); err != nil {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: objectKey}}
+}
@@ -0,0 +1,501 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// bundleProbeTimeout bounds how long the controller waits for the server
+	// of a bundle to tell its size
+	bundleProbeTimeout = 5 * time.Second
+
+	// defaultBundleLength is what storage is sized for when the source of a
+	// bundle does not report its size
+	defaultBundleLength = 20 * 1024 * 1024
+
+	// ociBundleFile is the name a bundle pulled from an oci artifact is stored under
+	ociBundleFile = "bundle.jsdos"
+
+	// bundleRevisionAnnotation is stamped on the job verifying the bundle of
+	// a game with the revision of the bundle it verifies
+	bundleRevisionAnnotation = "dosbox.contrib/bundle-revision"
+)
+
+const (
+	// the keys of a spec.bundle.credentialsSecretRef secret, all optional:
+	// username and password for basic auth, token for a bearer token and
+	// headers for any other http header, one "Name: value" per line
+	credentialsUsernameKey = "username"
+	credentialsPasswordKey = "password"
+	credentialsTokenKey    = "token"
+	credentialsHeadersKey  = "headers"
+)
+
+// VerifyBundle checks the digest of the bundle of a game with a
+// spec.bundle.sha256, recording the outcome in the BundleVerified condition.
+// The outcome is reused until either the spec changes or the game is
+// redeployed, as both may change the bundle being served. It returns false
+// while the bundle must not be rolled out, so the deployment of the game is
+// left alone and keeps serving the bundle it served before. Only bundles of
+// configmaps and secrets are read by the controller, downloading the others
+// would hold up the reconciliation of every game; they are verified by a job.
+func (r *GameReconciler) VerifyBundle(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (bool, error) {
+	condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionBundleVerified)
+
+	if game.Spec.Bundle.Sha256 == "" {
+		if condition == nil {
+			return true, nil
+		}
+
+		patch := client.MergeFrom(game.DeepCopy())
+		meta.RemoveStatusCondition(&game.Status.Conditions, operatorv1beta1.ConditionBundleVerified)
+
+		return true, r.Status().Patch(ctx, game, patch)
+	}
+
+	// failed reads are retried and running jobs awaited, everything else is
+	// settled
+	if condition != nil && condition.ObservedGeneration == game.Generation &&
+		condition.Reason != "ReadFailed" && condition.Status != metav1.ConditionUnknown &&
+		(game.Status.LastRedeployTime == nil || !game.Status.LastRedeployTime.After(condition.LastTransitionTime.Time)) {
+		return condition.Status == metav1.ConditionTrue, nil
+	}
+
+	if !bundleReadable(game) {
+		return r.verifyBundleJob(ctx, game)
+	}
+
+	expected := strings.ToLower(game.Spec.Bundle.Sha256)
+	digest, err := r.bundleDigest(ctx, game)
+
+	verified := metav1.Condition{
+		Type:               operatorv1beta1.ConditionBundleVerified,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: game.Generation,
+		Reason:             "DigestMatched",
+		Message:            fmt.Sprintf("bundle sha256 is %s", digest),
+	}
+
+	switch {
+	case err != nil:
+		verified.Status = metav1.ConditionFalse
+		verified.Reason = "ReadFailed"
+		verified.Message = err.Error()
+	case digest != expected:
+		verified.Status = metav1.ConditionFalse
+		verified.Reason = "DigestMismatch"
+		verified.Message = fmt.Sprintf("bundle sha256 is %s, expected %s", digest, expected)
+	}
+
+	// the transition time marks when the bundle was last verified, so it is
+	// renewed even if the outcome did not change
+	patch := client.MergeFrom(game.DeepCopy())
+	meta.RemoveStatusCondition(&game.Status.Conditions, operatorv1beta1.ConditionBundleVerified)
+	meta.SetStatusCondition(&game.Status.Conditions, verified)
+
+	if patchErr := r.Status().Patch(ctx, game, patch); patchErr != nil {
+		logger.V(5).Error(patchErr, "unable to patch game status")
+		return false, patchErr
+	}
+
+	if err != nil {
+		logger.Error(err, "unable to verify bundle")
+		return false, err
+	}
+
+	if verified.Status != metav1.ConditionTrue {
+		logger.Info(fmt.Sprintf("%s bundle is not rolled out: %s", strings.ToLower(game.Name), verified.Message))
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// verifyBundleJob verifies the bundle of a game the controller does not read
+// itself with a job, which fetches the bundle the way the pod of the game
+// does. A job of another revision of the bundle is replaced. A failed job is
+// left in place for inspection until it is deleted, the bundle changes or the
+// game is redeployed.
+func (r *GameReconciler) verifyBundleJob(ctx context.Context, game *operatorv1beta1.Game) (bool, error) {
+	parameters, err := r.deploymentParameters(game, nil, false)
+	if err != nil {
+		logger.Error(err, "unable to build deployment parameters")
+		return false, err
+	}
+
+	desired, err := assets.GetVerifyJob(parameters)
+	if err != nil {
+		logger.Error(err, "unable to parse job template")
+		return false, err
+	}
+
+	verified := metav1.Condition{
+		Type:               operatorv1beta1.ConditionBundleVerified,
+		Status:             metav1.ConditionUnknown,
+		ObservedGeneration: game.Generation,
+		Reason:             "Verifying",
+		Message:            fmt.Sprintf("job %s is verifying the bundle", desired.Name),
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(desired), job)
+	switch {
+	case apierrors.IsNotFound(err):
+		if err := ctrl.SetControllerReference(game, desired, r.Scheme); err != nil {
+			logger.Error(err, "unable to set controller reference")
+			return false, err
+		}
+
+		if err := r.Create(ctx, desired); err != nil {
+			logger.Error(err, "unable to create job")
+			return false, err
+		}
+
+		return false, r.setBundleVerified(ctx, game, verified)
+
+	case err != nil:
+		logger.V(5).Error(err, "unable to fetch job")
+		return false, err
+
+	case job.Annotations[bundleRevisionAnnotation] != desired.Annotations[bundleRevisionAnnotation]:
+		// its deletion reconciles the game again, which starts the job anew
+		err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete job")
+			return false, err
+		}
+
+		return false, r.setBundleVerified(ctx, game, verified)
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case batchv1.JobComplete:
+			verified.Status = metav1.ConditionTrue
+			verified.Reason = "DigestMatched"
+			verified.Message = fmt.Sprintf("bundle sha256 is %s", parameters.BundleSha256)
+		case batchv1.JobFailed:
+			mismatch, err := r.jobMismatch(ctx, job)
+			if err != nil {
+				return false, err
+			}
+
+			verified.Status = metav1.ConditionFalse
+			verified.Reason = "DigestMismatch"
+			verified.Message = mismatch
+			if mismatch == "" {
+				verified.Reason = "VerificationFailed"
+				verified.Message = fmt.Sprintf("job %s failed: %s, delete it to try again", job.Name, condition.Message)
+			}
+		}
+	}
+
+	if err := r.setBundleVerified(ctx, game, verified); err != nil {
+		return false, err
+	}
+
+	if verified.Status == metav1.ConditionFalse {
+		logger.Info(fmt.Sprintf("%s bundle is not rolled out: %s", strings.ToLower(game.Name), verified.Message))
+	}
+
+	return verified.Status == metav1.ConditionTrue, nil
+}
+
+// jobMismatch returns why the pods of a job refused the bundle they verified,
+// if they found it not matching its digest
+func (r *GameReconciler) jobMismatch(ctx context.Context, job *batchv1.Job) (string, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		logger.V(5).Error(err, "unable to list pods")
+		return "", err
+	}
+
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if mismatch := bundleMismatch(status); mismatch != "" {
+				return mismatch, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// setBundleVerified records the BundleVerified condition of a game, unless it
+// already holds
+func (r *GameReconciler) setBundleVerified(ctx context.Context, game *operatorv1beta1.Game, verified metav1.Condition) error {
+	current := meta.FindStatusCondition(game.Status.Conditions, verified.Type)
+	if current != nil && current.Status == verified.Status && current.Reason == verified.Reason &&
+		current.Message == verified.Message && current.ObservedGeneration == verified.ObservedGeneration {
+		return nil
+	}
+
+	patch := client.MergeFrom(game.DeepCopy())
+	meta.SetStatusCondition(&game.Status.Conditions, verified)
+
+	if err := r.Status().Patch(ctx, game, patch); err != nil {
+		logger.V(5).Error(err, "unable to patch game status")
+		return err
+	}
+
+	return nil
+}
+
+// bundleFile is the name the bundle of a game is stored and served under
+func bundleFile(game *operatorv1beta1.Game) string {
+	bundle := game.Spec.Bundle
+
+	switch {
+	case bundle.Url != "":
+		return filepath.Base(bundle.Url)
+	case bundle.ConfigMapRef != nil:
+		return bundle.ConfigMapRef.Key
+	case bundle.SecretRef != nil:
+		return bundle.SecretRef.Key
+	case bundle.PersistentVolumeClaimRef != nil:
+		return filepath.Base(bundle.PersistentVolumeClaimRef.Path)
+	default:
+		// the files of an artifact are named by whoever pushed it
+		return ociBundleFile
+	}
+}
+
+// bundleSource identifies the bundle of a game, and the size its storage is
+// set to if any, so a claim sized for another bundle can be told apart
+func bundleSource(game *operatorv1beta1.Game) string {
+	bundle := game.Spec.Bundle
+
+	source := ""
+	switch {
+	case bundle.Url != "":
+		source = fmt.Sprintf("url:%s", bundle.Url)
+	case bundle.Oci != "":
+		source = fmt.Sprintf("oci:%s", bundle.Oci)
+	case bundle.ConfigMapRef != nil:
+		source = fmt.Sprintf("configmap:%s/%s", bundle.ConfigMapRef.Name, bundle.ConfigMapRef.Key)
+	case bundle.SecretRef != nil:
+		source = fmt.Sprintf("secret:%s/%s", bundle.SecretRef.Name, bundle.SecretRef.Key)
+	case bundle.PersistentVolumeClaimRef != nil:
+		source = fmt.Sprintf("pvc:%s/%s", bundle.PersistentVolumeClaimRef.Name, bundle.PersistentVolumeClaimRef.Path)
+	}
+
+	if size := game.Spec.Persistence.Size; size != nil && !size.IsZero() {
+		source = fmt.Sprintf("%s size:%s", source, size.String())
+	}
+
+	return source
+}
+
+// bundleReadable reports whether the controller reads the bundle of a game
+// itself, from the api server
+func bundleReadable(game *operatorv1beta1.Game) bool {
+	return game.Spec.Bundle.ConfigMapRef != nil || game.Spec.Bundle.SecretRef != nil
+}
+
+// bundleData returns the bundle of a game kept in a configmap or a secret
+func (r *GameReconciler) bundleData(ctx context.Context, game *operatorv1beta1.Game) ([]byte, error) {
+	bundle := game.Spec.Bundle
+
+	if bundle.ConfigMapRef != nil {
+		cmap := &corev1.ConfigMap{}
+		objectKey := client.ObjectKey{Namespace: game.Namespace, Name: bundle.ConfigMapRef.Name}
+		if err := r.Get(ctx, objectKey, cmap); err != nil {
+			return nil, fmt.Errorf("unable to read bundle: %w", err)
+		}
+
+		if data, ok := cmap.BinaryData[bundle.ConfigMapRef.Key]; ok {
+			return data, nil
+		}
+
+		if data, ok := cmap.Data[bundle.ConfigMapRef.Key]; ok {
+			return []byte(data), nil
+		}
+
+		return nil, fmt.Errorf("unable to read bundle: configmap %s has no key %s", cmap.Name, bundle.ConfigMapRef.Key)
+	}
+
+	if bundle.SecretRef != nil {
+		secret := &corev1.Secret{}
+		objectKey := client.ObjectKey{Namespace: game.Namespace, Name: bundle.SecretRef.Name}
+		if err := r.Get(ctx, objectKey, secret); err != nil {
+			return nil, fmt.Errorf("unable to read bundle: %w", err)
+		}
+
+		if data, ok := secret.Data[bundle.SecretRef.Key]; ok {
+			return data, nil
+		}
+
+		return nil, fmt.Errorf("unable to read bundle: secret %s has no key %s", secret.Name, bundle.SecretRef.Key)
+	}
+
+	return nil, fmt.Errorf("bundle is neither in a configmap nor in a secret")
+}
+
+// bundleLength returns the size of the bundle as reported by its source, or
+// zero if the source does not tell
+func (r *GameReconciler) bundleLength(ctx context.Context, game *operatorv1beta1.Game) (int64, error) {
+	if game.Spec.Bundle.ConfigMapRef != nil || game.Spec.Bundle.SecretRef != nil {
+		data, err := r.bundleData(ctx, game)
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(len(data)), nil
+	}
+
+	// the size of an oci artifact or of a file on a claim is only known once
+	// it is pulled or copied
+	if game.Spec.Bundle.Url == "" {
+		return 0, nil
+	}
+
+	length, err := r.probeBundleLength(ctx, game, http.MethodHead)
+	if err == nil && length > 0 {
+		return length, nil
+	}
+
+	// servers refusing HEAD requests, or not telling the size of the bundle
+	// in their answer, are asked for its first byte instead
+	return r.probeBundleLength(ctx, game, http.MethodGet)
+}
+
+// probeBundleLength asks the server of a bundle for its size, with either a
+// HEAD request or a GET request for the first byte of the bundle. It returns
+// zero if the server does not tell.
+func (r *GameReconciler) probeBundleLength(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	method string,
+) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, bundleProbeTimeout)
+	defer cancel()
+
+	request, err := r.bundleRequest(ctx, game, method)
+	if err != nil {
+		return 0, err
+	}
+
+	if method == http.MethodGet {
+		request.Header.Set("Range", "bytes=0-0")
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("unable to probe bundle size: %w", err)
+	}
+	defer response.Body.Close()
+
+	header := ""
+	switch response.StatusCode {
+	case http.StatusOK:
+		header = response.Header.Get("Content-Length")
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<size>, where the size may be *
+		_, header, _ = strings.Cut(response.Header.Get("Content-Range"), "/")
+	default:
+		return 0, fmt.Errorf("unable to probe bundle size: %s", response.Status)
+	}
+
+	length, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+
+	return length, nil
+}
+
+// bundleDigest reads the bundle of a configmap or a secret and returns its
+// hex encoded sha256
+func (r *GameReconciler) bundleDigest(ctx context.Context, game *operatorv1beta1.Game) (string, error) {
+	data, err := r.bundleData(ctx, game)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// bundleRequest builds a request for the bundle of a game, authenticated with
+// the credentials of spec.bundle.credentialsSecretRef. The init container of
+// the game reads the same keys of the secret.
+func (r *GameReconciler) bundleRequest(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	method string,
+) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, game.Spec.Bundle.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if game.Spec.Bundle.CredentialsSecretRef == nil {
+		return request, nil
+	}
+
+	secret := &corev1.Secret{}
+	objectKey := client.ObjectKey{
+		Namespace: game.Namespace,
+		Name:      game.Spec.Bundle.CredentialsSecretRef.Name,
+	}
+	if err := r.Get(ctx, objectKey, secret); err != nil {
+		logger.V(5).Error(err, "unable to fetch bundle credentials")
+		return nil, err
+	}
+
+	setCredentials(request, secret)
+
+	return request, nil
+}
+
+// setCredentials authenticates a request with the username and password, the
+// token and the headers of a credentials secret
+func setCredentials(request *http.Request, secret *corev1.Secret) {
+	if username, ok := secret.Data[credentialsUsernameKey]; ok {
+		request.SetBasicAuth(credential(username), credential(secret.Data[credentialsPasswordKey]))
+	}
+
+	if token, ok := secret.Data[credentialsTokenKey]; ok {
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", credential(token)))
+	}
+
+	for _, line := range strings.Split(string(secret.Data[credentialsHeadersKey]), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		request.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+// credential drops the trailing line break files written by hand usually end
+// with, the same way the shell of the init container does
+func credential(value []byte) string {
+	return strings.TrimRight(string(value), "\r\n")
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBundleRequestCredentials(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdn-credentials", Namespace: "default"},
+		Data: map[string][]byte{
+			credentialsUsernameKey: []byte("player\n"),
+			credentialsPasswordKey: []byte("insert-coin\n"),
+			credentialsHeadersKey:  []byte("X-Api-Key: 1983\nX-Tenant:arcade\n\nnot a header"),
+		},
+	}
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+		Spec: operatorv1beta1.GameSpec{
+			Bundle: operatorv1beta1.BundleSpec{
+				Url:                  "https://artifacts.local/games/packman.jsdos",
+				CredentialsSecretRef: &corev1.LocalObjectReference{Name: secret.Name},
+			},
+		},
+	}
+
+	r := &GameReconciler{Client: fake.NewClientBuilder().WithObjects(secret).Build()}
+
+	request, err := r.bundleRequest(context.Background(), game, http.MethodHead)
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+
+	username, password, ok := request.BasicAuth()
+	if !ok || username != "player" || password != "insert-coin" {
+		t.Errorf("basic auth is %q:%q, expected player:insert-coin", username, password)
+	}
+
+	if request.Header.Get("X-Api-Key") != "1983" || request.Header.Get("X-Tenant") != "arcade" {
+		t.Errorf("custom headers are not set: %v", request.Header)
+	}
+}
+
+func TestBundleFromConfigMap(t *testing.T) {
+	cmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundles", Namespace: "default"},
+		BinaryData: map[string][]byte{"packman.jsdos": []byte("PK\x03\x04")},
+	}
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+		Spec: operatorv1beta1.GameSpec{
+			Bundle: operatorv1beta1.BundleSpec{
+				ConfigMapRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: cmap.Name},
+					Key:                  "packman.jsdos",
+				},
+			},
+		},
+	}
+
+	r := &GameReconciler{Client: fake.NewClientBuilder().WithObjects(cmap).Build()}
+
+	if file := bundleFile(game); file != "packman.jsdos" {
+		t.Errorf("bundle file is %s, expected packman.jsdos", file)
+	}
+
+	length, err := r.bundleLength(context.Background(), game)
+	if err != nil || length != 4 {
+		t.Errorf("bundle length is %d (%v), expected 4", length, err)
+	}
+
+	digest, err := r.bundleDigest(context.Background(), game)
+	if err != nil || digest != "8dcc7e601606217f3b754766511182a916b17e9a26a94c9d887104eba92e9bb2" {
+		t.Errorf("bundle digest is %s (%v)", digest, err)
+	}
+}
+
+func TestBundleVerifiedByJob(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default", Generation: 2, UID: "packman"},
+		Spec: operatorv1beta1.GameSpec{
+			Deploy: true,
+			Bundle: operatorv1beta1.BundleSpec{
+				Url:    "https://cdn.dos.zone/custom/dos/packman.jsdos",
+				Sha256: "8DCC7E601606217F3B754766511182A916B17E9A26A94C9D887104EBA92E9BB2",
+			},
+		},
+	}
+
+	r := newFakeReconciler(game)
+	ctx := context.Background()
+	jobKey := client.ObjectKey{Namespace: "default", Name: "packman-verify"}
+
+	verify := func(want bool, reason string) *batchv1.Job {
+		t.Helper()
+
+		verified, err := r.VerifyBundle(ctx, ctrl.Request{}, game)
+		if err != nil || verified != want {
+			t.Fatalf("bundle is verified %v (%v), expected %v", verified, err, want)
+		}
+
+		condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionBundleVerified)
+		if condition == nil || condition.Reason != reason {
+			t.Fatalf("BundleVerified condition is %+v, expected %s", condition, reason)
+		}
+
+		job := &batchv1.Job{}
+		if err := r.Get(ctx, jobKey, job); err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("fetching job: %v", err)
+		}
+
+		return job
+	}
+
+	// the bundle is held back until the job checked it
+	job := verify(false, "Verifying")
+	args := strings.Join(job.Spec.Template.Spec.Containers[0].Args, " ")
+	if !strings.Contains(args, `"https://cdn.dos.zone/custom/dos/packman.jsdos"`) ||
+		!strings.Contains(args, "8dcc7e601606217f3b754766511182a916b17e9a26a94c9d887104eba92e9bb2") {
+		t.Errorf("job does not verify the bundle against its digest: %s", args)
+	}
+
+	mismatch := "bundle sha256 is 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824, expected 8dcc7e601606217f3b754766511182a916b17e9a26a94c9d887104eba92e9bb2\n"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman-verify-x7k2", Namespace: "default", Labels: map[string]string{"job-name": job.Name}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "verify",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Message: mismatch}},
+			}},
+		},
+	}
+	if err := r.Create(ctx, pod); err != nil {
+		t.Fatalf("creating pod: %v", err)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err := r.Status().Update(ctx, job); err != nil {
+		t.Fatalf("failing job: %v", err)
+	}
+
+	verify(false, "DigestMismatch")
+
+	// a redeployment verifies the bundle again with a new job
+	game.Status.LastRedeployTime = &metav1.Time{Time: time.Now().Add(time.Minute)}
+	if job := verify(false, "Verifying"); job.Name != "" {
+		t.Errorf("job of another revision is kept: %+v", job.Annotations)
+	}
+
+	job = verify(false, "Verifying")
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := r.Status().Update(ctx, job); err != nil {
+		t.Fatalf("completing job: %v", err)
+	}
+
+	verify(true, "DigestMatched")
+
+	// a bundle changed at its source since is refused by the pod
+	gamePod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman-6d5f", Namespace: "default"},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "packman-init-bundle",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				LastTerminationState: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Message: mismatch},
+				},
+			}},
+		},
+	}
+
+	setObservedStatus(game, observePod(gamePod, game.Name))
+	condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionBundleVerified)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Message != strings.TrimSpace(mismatch) {
+		t.Errorf("BundleVerified condition of a bundle refused by the pod is %+v", condition)
+	}
+}
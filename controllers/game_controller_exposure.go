@@ -0,0 +1,403 @@
+package controllers
+
+import (
+	"context"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net"
+	"net/url"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	httpRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+	gatewayGVK   = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "Gateway"}
+)
+
+//+kubebuilder:rbac:groups="networking.k8s.io",resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="gateway.networking.k8s.io",resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="gateway.networking.k8s.io",resources=gateways,verbs=get
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+
+// serviceType is the type of the service of a game exposed the given way.
+// Ingresses and HTTPRoutes forward to a ClusterIP service.
+func serviceType(exposure operatorv1beta1.ExposureType) corev1.ServiceType {
+	switch exposure {
+	case operatorv1beta1.ExposureTypeNodePort:
+		return corev1.ServiceTypeNodePort
+	case operatorv1beta1.ExposureTypeLoadBalancer:
+		return corev1.ServiceTypeLoadBalancer
+	default:
+		return corev1.ServiceTypeClusterIP
+	}
+}
+
+// servedPath is the path a game is served under, ending with a slash
+func servedPath(game *operatorv1beta1.Game) string {
+	path := game.Spec.Exposure.Path
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	return path
+}
+
+func routeParameters(game *operatorv1beta1.Game) assets.RouteParameters {
+	exposure := game.Spec.Exposure
+
+	parameters := assets.RouteParameters{
+		Namespace: game.Namespace,
+		Name:      game.Name,
+		Port:      exposure.Port,
+		Host:      exposure.Host,
+	}
+
+	// a prefix without the trailing slash also routes the bare path, which
+	// the game redirects to the path with the slash
+	parameters.Path = strings.TrimSuffix(servedPath(game), "/")
+	if parameters.Path == "" {
+		parameters.Path = "/"
+	}
+
+	if ingress := exposure.Ingress; ingress != nil {
+		if ingress.ClassName != nil {
+			parameters.ClassName = *ingress.ClassName
+		}
+		parameters.TLSSecretName = ingress.TLSSecretName
+		parameters.Annotations = ingress.Annotations
+	}
+
+	if route := exposure.HTTPRoute; route != nil {
+		for _, parent := range route.ParentRefs {
+			parameters.ParentRefs = append(parameters.ParentRefs, assets.ParentReference{
+				Name:        parent.Name,
+				Namespace:   parent.Namespace,
+				SectionName: parent.SectionName,
+			})
+		}
+	}
+
+	return parameters
+}
+
+// CreateOrUpdateIngress creates the Ingress of a game exposed through one, and
+// deletes it once the game is exposed another way
+func (r *GameReconciler) CreateOrUpdateIngress(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+	deployment *appsv1.Deployment,
+) (*networkingv1.Ingress, error) {
+	create := false
+
+	ingress := &networkingv1.Ingress{}
+	err := r.Get(ctx, req.NamespacedName, ingress)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			create = true
+		} else {
+			logger.V(5).Error(err, "unable to fetch ingress")
+			return nil, err
+		}
+	}
+
+	if game.Spec.Exposure.Type != operatorv1beta1.ExposureTypeIngress {
+		if create || !metav1.IsControlledBy(ingress, deployment) {
+			return nil, nil
+		}
+
+		err = r.Delete(ctx, ingress)
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete ingress")
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	desired, err := assets.GetIngress(routeParameters(game))
+	if err != nil {
+		logger.Error(err, "unable to parse ingress template")
+		return nil, err
+	}
+
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
+
+	if !create && !drifted(desired, ingress, desired.Spec, ingress.Spec) {
+		return ingress, nil
+	}
+
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply ingress")
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// CreateOrUpdateHTTPRoute creates the HTTPRoute of a game exposed through one,
+// and deletes it once the game is exposed another way. Clusters without the
+// Gateway API only fail the games asking for a route.
+func (r *GameReconciler) CreateOrUpdateHTTPRoute(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+	deployment *appsv1.Deployment,
+) (*unstructured.Unstructured, error) {
+	create := false
+
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(httpRouteGVK)
+	err := r.Get(ctx, req.NamespacedName, route)
+	if err != nil {
+		switch {
+		case apierrors.IsNotFound(err):
+			create = true
+		case meta.IsNoMatchError(err) && game.Spec.Exposure.Type != operatorv1beta1.ExposureTypeHTTPRoute:
+			return nil, nil
+		default:
+			logger.V(5).Error(err, "unable to fetch httproute")
+			return nil, err
+		}
+	}
+
+	if game.Spec.Exposure.Type != operatorv1beta1.ExposureTypeHTTPRoute {
+		if create || !metav1.IsControlledBy(route, deployment) {
+			return nil, nil
+		}
+
+		err = r.Delete(ctx, route)
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete httproute")
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	desired, err := assets.GetHTTPRoute(routeParameters(game))
+	if err != nil {
+		logger.Error(err, "unable to parse httproute template")
+		return nil, err
+	}
+
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
+
+	if !create && !drifted(desired, route, desired.Object["spec"], route.Object["spec"]) {
+		return route, nil
+	}
+
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply httproute")
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// GameUrl works out the address players open the game at. It is empty as long
+// as the address is not known yet, such as while a load balancer is
+// provisioned or before the gateway of a route is programmed.
+func (r *GameReconciler) GameUrl(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	svc *corev1.Service,
+	ingress *networkingv1.Ingress,
+	route *unstructured.Unstructured,
+) (string, error) {
+	exposure := game.Spec.Exposure
+
+	switch exposure.Type {
+	case operatorv1beta1.ExposureTypeNodePort:
+		if svc == nil || len(svc.Spec.Ports) == 0 || svc.Spec.Ports[0].NodePort == 0 {
+			return "", nil
+		}
+
+		address, err := r.nodeAddress(ctx)
+		if err != nil || address == "" {
+			return "", err
+		}
+
+		return httpUrl("http", address, svc.Spec.Ports[0].NodePort, "/"), nil
+	case operatorv1beta1.ExposureTypeLoadBalancer:
+		if svc == nil || len(svc.Spec.Ports) == 0 {
+			return "", nil
+		}
+
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			if address := firstOf(lb.Hostname, lb.IP); address != "" {
+				return httpUrl("http", address, svc.Spec.Ports[0].Port, "/"), nil
+			}
+		}
+
+		return "", nil
+	case operatorv1beta1.ExposureTypeIngress:
+		if ingress == nil {
+			return "", nil
+		}
+
+		scheme := "http"
+		if exposure.Ingress != nil && exposure.Ingress.TLSSecretName != "" {
+			scheme = "https"
+		}
+
+		address := exposure.Host
+		if address == "" {
+			for _, lb := range ingress.Status.LoadBalancer.Ingress {
+				if address = firstOf(lb.Hostname, lb.IP); address != "" {
+					break
+				}
+			}
+		}
+
+		if address == "" || strings.HasPrefix(address, "*") {
+			return "", nil
+		}
+
+		return httpUrl(scheme, address, 0, servedPath(game)), nil
+	case operatorv1beta1.ExposureTypeHTTPRoute:
+		if route == nil || exposure.HTTPRoute == nil || len(exposure.HTTPRoute.ParentRefs) == 0 {
+			return "", nil
+		}
+
+		return r.gatewayUrl(ctx, game, exposure.HTTPRoute.ParentRefs[0])
+	default:
+		return serviceEndpoint(svc), nil
+	}
+}
+
+// gatewayUrl works out the address of a game routed by the given listener of
+// a gateway: https if the listener terminates tls, at the host of the game or
+// else the address of the gateway.
+func (r *GameReconciler) gatewayUrl(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	parent operatorv1beta1.GatewayReference,
+) (string, error) {
+	gateway := &unstructured.Unstructured{}
+	gateway.SetGroupVersionKind(gatewayGVK)
+
+	objectKey := client.ObjectKey{Namespace: firstOf(parent.Namespace, game.Namespace), Name: parent.Name}
+	if err := r.Get(ctx, objectKey, gateway); err != nil {
+		if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return "", nil
+		}
+
+		logger.V(5).Error(err, "unable to fetch gateway")
+		return "", err
+	}
+
+	scheme := "http"
+	var port int32
+
+	listeners, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	for _, item := range listeners {
+		listener, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _, _ := unstructured.NestedString(listener, "name")
+		if parent.SectionName != "" && name != parent.SectionName {
+			continue
+		}
+
+		protocol, _, _ := unstructured.NestedString(listener, "protocol")
+		if protocol == "HTTPS" {
+			scheme = "https"
+		}
+
+		number, _, _ := unstructured.NestedInt64(listener, "port")
+		port = int32(number)
+		break
+	}
+
+	address := game.Spec.Exposure.Host
+	if address == "" {
+		addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+		for _, item := range addresses {
+			if value, ok := item.(map[string]interface{})["value"].(string); ok && value != "" {
+				address = value
+				break
+			}
+		}
+	}
+
+	if address == "" || strings.HasPrefix(address, "*") {
+		return "", nil
+	}
+
+	return httpUrl(scheme, address, port, servedPath(game)), nil
+}
+
+// nodeAddress returns an address the nodes of the cluster are reached at,
+// preferring external addresses over internal ones
+func (r *GameReconciler) nodeAddress(ctx context.Context) (string, error) {
+	nodes := &corev1.NodeList{}
+	if err := r.List(ctx, nodes); err != nil {
+		logger.V(5).Error(err, "unable to list nodes")
+		return "", err
+	}
+
+	sort.Slice(nodes.Items, func(i, j int) bool {
+		return nodes.Items[i].Name < nodes.Items[j].Name
+	})
+
+	for _, addressType := range []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP} {
+		for _, node := range nodes.Items {
+			for _, address := range node.Status.Addresses {
+				if address.Type == addressType && address.Address != "" {
+					return address.Address, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// httpUrl formats the url of a game, leaving out the port if it is the
+// default one of the scheme or zero
+func httpUrl(scheme string, host string, port int32, path string) string {
+	if port != 0 && !(scheme == "http" && port == 80) && !(scheme == "https" && port == 443) {
+		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	return (&url.URL{Scheme: scheme, Host: host, Path: path}).String()
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestGameUrl(t *testing.T) {
+	nodes := []*corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.11"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-2"},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.12"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.12"},
+			}},
+		},
+	}
+
+	r := newFakeReconciler(nodes[0], nodes[1])
+
+	svc := func(port int32, nodePort int32, lb ...corev1.LoadBalancerIngress) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: port, NodePort: nodePort}}},
+			Status:     corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: lb}},
+		}
+	}
+
+	ingress := &networkingv1.Ingress{
+		Status: networkingv1.IngressStatus{LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+			Ingress: []networkingv1.IngressLoadBalancerIngress{{IP: "198.51.100.7"}},
+		}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		exposure operatorv1beta1.ExposureSpec
+		svc      *corev1.Service
+		ingress  *networkingv1.Ingress
+		want     string
+	}{
+		{
+			name:     "cluster ip",
+			exposure: operatorv1beta1.ExposureSpec{Port: 8080, Type: operatorv1beta1.ExposureTypeClusterIP},
+			svc:      svc(8080, 0),
+			want:     "http://doom.arcade.svc:8080",
+		},
+		{
+			name:     "node port on an external address",
+			exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeNodePort},
+			svc:      svc(80, 30080),
+			want:     "http://203.0.113.12:30080/",
+		},
+		{
+			name:     "load balancer not provisioned yet",
+			exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeLoadBalancer},
+			svc:      svc(80, 30080),
+		},
+		{
+			name:     "load balancer",
+			exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeLoadBalancer},
+			svc:      svc(80, 30080, corev1.LoadBalancerIngress{Hostname: "doom.elb.example.com"}),
+			want:     "http://doom.elb.example.com/",
+		},
+		{
+			name: "ingress with tls",
+			exposure: operatorv1beta1.ExposureSpec{
+				Port:    80,
+				Type:    operatorv1beta1.ExposureTypeIngress,
+				Host:    "arcade.example.com",
+				Path:    "/doom",
+				Ingress: &operatorv1beta1.IngressExposure{TLSSecretName: "arcade-tls"},
+			},
+			svc:     svc(80, 0),
+			ingress: ingress,
+			want:    "https://arcade.example.com/doom/",
+		},
+		{
+			name:     "ingress without a host",
+			exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeIngress, Path: "/"},
+			svc:      svc(80, 0),
+			ingress:  ingress,
+			want:     "http://198.51.100.7/",
+		},
+	} {
+		game := &operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+			Spec:       operatorv1beta1.GameSpec{Exposure: tc.exposure},
+		}
+
+		url, err := r.GameUrl(context.Background(), game, tc.svc, tc.ingress, nil)
+		if err != nil || url != tc.want {
+			t.Errorf("%s: url is %q (%v), expected %q", tc.name, url, err, tc.want)
+		}
+	}
+}
+
+func TestRouteQuoting(t *testing.T) {
+	hostile := "nginx\n  rules: [{host: evil.example.com}]\nx: {"
+	className := hostile
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameSpec{
+			Exposure: operatorv1beta1.ExposureSpec{
+				Port: 80,
+				Type: operatorv1beta1.ExposureTypeIngress,
+				Host: "arcade.example.com",
+				Ingress: &operatorv1beta1.IngressExposure{
+					ClassName:     &className,
+					TLSSecretName: "tls: " + hostile,
+				},
+				HTTPRoute: &operatorv1beta1.HTTPRouteExposure{
+					ParentRefs: []operatorv1beta1.GatewayReference{
+						{Name: "gw: " + hostile, Namespace: "{ns}", SectionName: "https\nport: 1"},
+					},
+				},
+			},
+		},
+	}
+
+	ingress, err := assets.GetIngress(routeParameters(game))
+	if err != nil {
+		t.Fatalf("rendering ingress: %v", err)
+	}
+
+	if *ingress.Spec.IngressClassName != hostile || ingress.Spec.TLS[0].SecretName != "tls: "+hostile ||
+		len(ingress.Spec.Rules) != 1 || ingress.Spec.Rules[0].Host != "arcade.example.com" {
+		t.Errorf("ingress took in the values of the game as yaml: %+v", ingress.Spec)
+	}
+
+	route, err := assets.GetHTTPRoute(routeParameters(game))
+	if err != nil {
+		t.Fatalf("rendering route: %v", err)
+	}
+
+	parents, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	if len(parents) != 1 {
+		t.Fatalf("route has parents %+v", parents)
+	}
+
+	parent := parents[0].(map[string]interface{})
+	if parent["name"] != "gw: "+hostile || parent["namespace"] != "{ns}" || parent["sectionName"] != "https\nport: 1" || len(parent) != 3 {
+		t.Errorf("route took in the values of the game as yaml: %+v", parent)
+	}
+}
+
+func TestServesHTTPRoutes(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+
+	routes, err := servesHTTPRoutes(mapper)
+	if err != nil || routes {
+		t.Errorf("cluster without the gateway api serves httproutes: %v, %v", routes, err)
+	}
+
+	mapper.Add(httpRouteGVK, meta.RESTScopeNamespace)
+
+	routes, err = servesHTTPRoutes(mapper)
+	if err != nil || !routes {
+		t.Errorf("cluster with the gateway api does not serve httproutes: %v, %v", routes, err)
+	}
+}
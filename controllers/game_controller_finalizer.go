@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+)
+
+const (
+	gameFinalizer = "operator.contrib.dosbox.com/finalizer"
+)
+
+// AddFinalizer makes sure the game is not removed before Finalize cleaned up
+// after it.
+func (r *GameReconciler) AddFinalizer(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) error {
+	if controllerutil.ContainsFinalizer(game, gameFinalizer) {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(game.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.AddFinalizer(game, gameFinalizer)
+
+	err := r.Patch(ctx, game, patch)
+	if err != nil {
+		logger.Error(err, "unable to add finalizer")
+		return err
+	}
+
+	return nil
+}
+
+// Finalize removes the resources of a deleted game in order: first everything
+// that serves the game, then, once its pods are gone, its storage and the shared
+// emulator assets if no other deployed game in the namespace needs them. It
+// returns false while it is still waiting for the pods of the game to go away.
+func (r *GameReconciler) Finalize(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (bool, error) {
+	if !controllerutil.ContainsFinalizer(game, gameFinalizer) {
+		return true, nil
+	}
+
+	retain := game.Spec.Persistence.RetentionPolicy == operatorv1beta1.RetentionPolicyRetain
+
+	if retain {
+		err := r.OrphanPersistentVolumeClaim(ctx, req, game)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, object := range []client.Object{
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: fmt.Sprintf("%s-index-configmap", req.Name)}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}},
+	} {
+		err := r.Delete(ctx, object, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete game resource")
+			return false, err
+		}
+	}
+
+	pods := &corev1.PodList{}
+	opts := []client.ListOption{
+		client.MatchingLabels(map[string]string{"app": req.Name}),
+		client.InNamespace(req.Namespace),
+	}
+
+	if err := r.List(ctx, pods, opts...); err != nil {
+		return false, err
+	}
+
+	if len(pods.Items) > 0 {
+		logger.Info(fmt.Sprintf("waiting for the pods of %s to terminate", strings.ToLower(game.Name)))
+		return false, nil
+	}
+
+	if !retain {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: fmt.Sprintf("%s-pvc", req.Name)},
+		}
+
+		err := r.Delete(ctx, pvc)
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete pvc")
+			return false, err
+		}
+	}
+
+	// retain only keeps the claim of the game, the shared assets go either way
+	err := r.DeletePersistentVolumeClaimAssets(ctx, req)
+	if err != nil {
+		return false, err
+	}
+
+	patch := client.MergeFromWithOptions(game.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.RemoveFinalizer(game, gameFinalizer)
+
+	err = r.Patch(ctx, game, patch)
+	if err != nil {
+		logger.Error(err, "unable to remove finalizer")
+		return false, err
+	}
+
+	logger.Info(fmt.Sprintf("%s is finalized", strings.ToLower(game.Name)))
+
+	return true, nil
+}
+
+// OrphanPersistentVolumeClaim drops the owner references of the game pvc, so
+// the garbage collector keeps it after the deployment of the game is deleted.
+func (r *GameReconciler) OrphanPersistentVolumeClaim(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) error {
+	pvc := &corev1.PersistentVolumeClaim{}
+	objectKey := client.ObjectKey{
+		Namespace: req.Namespace,
+		Name:      fmt.Sprintf("%s-pvc", req.Name),
+	}
+	err := r.Get(ctx, objectKey, pvc)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		logger.V(5).Error(err, "unable to fetch pvc")
+		return err
+	}
+
+	if len(pvc.OwnerReferences) == 0 {
+		return nil
+	}
+
+	patch := client.MergeFrom(pvc.DeepCopy())
+	pvc.OwnerReferences = nil
+
+	err = r.Patch(ctx, pvc, patch)
+	if err != nil {
+		logger.Error(err, "unable to orphan pvc")
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("%s is retained", pvc.Name))
+
+	return nil
+}
+
+// DeletePersistentVolumeClaimAssets removes the shared emulator assets pvc of
+// the namespace, unless a deployed game that is not being deleted still uses it.
+// Games referencing a JsDosRuntime use the claims of their runtime instead.
+func (r *GameReconciler) DeletePersistentVolumeClaimAssets(
+	ctx context.Context,
+	req ctrl.Request,
+) error {
+	games := &operatorv1beta1.GameList{}
+	if err := r.List(ctx, games, client.InNamespace(req.Namespace)); err != nil {
+		return err
+	}
+
+	for _, game := range games.Items {
+		if game.Name == req.Name {
+			continue
+		}
+
+		if game.Spec.Deploy && game.DeletionTimestamp.IsZero() && game.Spec.RuntimeRef == nil {
+			return nil
+		}
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: defaultAssetsClaim},
+	}
+
+	err := r.Delete(ctx, pvc)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		logger.Error(err, "unable to delete pvc")
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("%s is removed", pvc.Name))
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestFinalizeRetainedGame(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade", Finalizers: []string{gameFinalizer}},
+		Spec: operatorv1beta1.GameSpec{
+			Deploy:      true,
+			Persistence: operatorv1beta1.PersistenceSpec{RetentionPolicy: operatorv1beta1.RetentionPolicyRetain},
+		},
+	}
+
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "doom-pvc", Namespace: "arcade"}}
+	assets := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: defaultAssetsClaim, Namespace: "arcade"}}
+
+	r := newFakeReconciler(game, claim, assets)
+
+	ctx := context.Background()
+	done, err := r.Finalize(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(game)}, game)
+	if err != nil || !done {
+		t.Fatalf("finalizing game is %v (%v)", done, err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(claim), claim); err != nil {
+		t.Errorf("retained claim is gone: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(assets), assets); !apierrors.IsNotFound(err) {
+		t.Errorf("shared assets claim outlives the last game: %v", err)
+	}
+}
+
+func TestFinalizerOfUndeployedGame(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec:       operatorv1beta1.GameSpec{Deploy: false},
+	}
+
+	r := newFakeReconciler(game)
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(game)}); err != nil {
+		t.Fatalf("reconciling undeployed game: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(game), game); err != nil {
+		t.Fatalf("fetching game: %v", err)
+	}
+
+	if !controllerutil.ContainsFinalizer(game, gameFinalizer) {
+		t.Errorf("undeployed game has no finalizer: %v", game.Finalizers)
+	}
+}
@@ -2,26 +2,53 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	operatorv1alpha1 "github.com/akyriako/kube-dosbox/api/v1alpha1"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
 	"github.com/akyriako/kube-dosbox/assets"
 	"github.com/heistp/antler/node/metric"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"math"
-	"net/http"
-	"path/filepath"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	fieldManager = "kube-dosbox"
+	// savesPort is the port the save service of a game or the instance of a
+	// session listens at, on the localhost of its pod
+	savesPort = 8090
+)
+
+// apply server-side applies the desired object, creating it if it does not
+// exist yet. On success the desired object holds the live state.
+func (r *GameReconciler) apply(ctx context.Context, desired client.Object) error {
+	return r.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// drifted reports whether the live object lost any of the desired labels,
+// annotations or owner references, or whether its spec diverged from the
+// desired one. Fields left empty in the desired objects are ignored, so
+// values defaulted by the api server do not count as drift.
+func drifted(desired client.Object, live client.Object, desiredSpec any, liveSpec any) bool {
+	return !equality.Semantic.DeepDerivative(desired.GetLabels(), live.GetLabels()) ||
+		!equality.Semantic.DeepDerivative(desired.GetAnnotations(), live.GetAnnotations()) ||
+		!equality.Semantic.DeepDerivative(desired.GetOwnerReferences(), live.GetOwnerReferences()) ||
+		!equality.Semantic.DeepDerivative(desiredSpec, liveSpec)
+}
+
 func (r *GameReconciler) CreateOrUpdateDeployment(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	stopped bool,
 ) (*appsv1.Deployment, error) {
 	create := false
 
@@ -36,35 +63,126 @@ func (r *GameReconciler) CreateOrUpdateDeployment(
 		}
 	}
 
-	if create {
-		deployment, err = assets.GetDeployment(game.Namespace, game.Name, game.Spec.Port, game.Spec.Url)
-		if err != nil {
-			logger.Error(err, "unable to parse deployment template")
-			return nil, err
-		}
+	parameters, err := r.deploymentParameters(game, jsdos, stopped)
+	if err != nil {
+		logger.Error(err, "unable to build deployment parameters")
+		return nil, err
+	}
 
-		err = ctrl.SetControllerReference(game, deployment, r.Scheme)
-		if err != nil {
-			logger.Error(err, "unable to set controller reference")
-			return nil, err
-		}
+	desired, err := assets.GetDeployment(parameters)
+	if err != nil {
+		logger.Error(err, "unable to parse deployment template")
+		return nil, err
+	}
 
-		err = r.Create(ctx, deployment)
-		if err != nil {
-			logger.Error(err, "unable to create deployment")
-			return nil, err
-		}
+	err = ctrl.SetControllerReference(game, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
 
+	if !create && !drifted(desired, deployment, desired.Spec, deployment.Spec) {
 		return deployment, nil
 	}
 
-	return deployment, nil
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply deployment")
+		return nil, err
+	}
+
+	if !create {
+		logger.Info(fmt.Sprintf("%s deployment is updated", strings.ToLower(game.Name)))
+	}
+
+	return desired, nil
+}
+
+// deploymentParameters are the values the deployment of a game is rendered
+// with
+func (r *GameReconciler) deploymentParameters(
+	game *operatorv1beta1.Game,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	stopped bool,
+) (assets.DeploymentParameters, error) {
+	redeployedAt := ""
+	if game.Status.LastRedeployTime != nil {
+		redeployedAt = game.Status.LastRedeployTime.UTC().Format(time.RFC3339)
+	}
+
+	parameters := assets.DeploymentParameters{
+		Namespace:      game.Namespace,
+		Name:           game.Name,
+		Port:           game.Spec.Exposure.Port,
+		Bundle:         bundleFile(game),
+		BundleUrl:      game.Spec.Bundle.Url,
+		BundleOci:      game.Spec.Bundle.Oci,
+		BundleSha256:   strings.ToLower(game.Spec.Bundle.Sha256),
+		RedeployedAt:   redeployedAt,
+		BundleRevision: bundleRevision(game, redeployedAt),
+		Path:           servedPath(game),
+		Stopped:        stopped,
+		RuntimeVersion: r.runtimeVersion(game, jsdos),
+		Resources:      game.Spec.Resources,
+	}
+
+	// players share the save service of the game, each reaching only their
+	// own saves with the token the service hands out to them
+	if r.SavesImage != "" {
+		parameters.SavesImage = r.SavesImage
+		parameters.SavesPort = savesPort
+		parameters.SavesQuota = r.Sizer.Saves
+	}
+
+	if r.activated(game) {
+		parameters.StatusPort = statusPort
+	}
+
+	checksum, err := indexChecksum(r.configMapParameters(game))
+	if err != nil {
+		return parameters, err
+	}
+	parameters.IndexChecksum = checksum
+
+	if game.Spec.Persistence.Mode == operatorv1beta1.PersistenceModeEmptyDir {
+		parameters.EmptyDir = true
+		if size := game.Spec.Persistence.Size; size != nil && !size.IsZero() {
+			parameters.EmptyDirSizeLimit = size.String()
+		}
+	}
+
+	// the assets of a JsDosRuntime are already in place, otherwise the game
+	// downloads them to the assets claim of the namespace
+	if jsdos != nil {
+		parameters.AssetsClaim = runtimeClaim(jsdos.Name)
+	} else {
+		parameters.AssetsClaim = defaultAssetsClaim
+		parameters.RuntimeUrl = strings.ReplaceAll(r.RuntimeUrl, "{version}", parameters.RuntimeVersion)
+	}
+
+	switch bundle := game.Spec.Bundle; {
+	case bundle.ConfigMapRef != nil:
+		parameters.BundleConfigMap = bundle.ConfigMapRef.Name
+		parameters.BundlePath = bundle.ConfigMapRef.Key
+	case bundle.SecretRef != nil:
+		parameters.BundleSecret = bundle.SecretRef.Name
+		parameters.BundlePath = bundle.SecretRef.Key
+	case bundle.PersistentVolumeClaimRef != nil:
+		parameters.BundleClaim = bundle.PersistentVolumeClaimRef.Name
+		parameters.BundlePath = bundle.PersistentVolumeClaimRef.Path
+	}
+
+	if game.Spec.Bundle.CredentialsSecretRef != nil {
+		parameters.CredentialsSecret = game.Spec.Bundle.CredentialsSecretRef.Name
+	}
+
+	return parameters, nil
 }
 
 func (r *GameReconciler) DeleteDeployment(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
 ) error {
 	deployment := &appsv1.Deployment{}
 	err := r.Get(ctx, req.NamespacedName, deployment)
@@ -90,7 +208,7 @@ func (r *GameReconciler) DeleteDeployment(
 func (r *GameReconciler) CreateOrUpdateConfigMap(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
 	deployment *appsv1.Deployment,
 ) (*corev1.ConfigMap, error) {
 	create := false
@@ -110,37 +228,127 @@ func (r *GameReconciler) CreateOrUpdateConfigMap(
 		}
 	}
 
-	if create {
-		cmap, err = assets.GetConfigMap(game.Namespace, game.Name, filepath.Base(game.Spec.Url))
-		if err != nil {
-			logger.Error(err, "unable to parse configmap template")
-			return nil, err
-		}
-
-		err = ctrl.SetControllerReference(deployment, cmap, r.Scheme)
-		if err != nil {
-			logger.Error(err, "unable to set controller reference")
-			return nil, err
-		}
+	desired, err := assets.GetConfigMap(r.configMapParameters(game))
+	if err != nil {
+		logger.Error(err, "unable to parse configmap template")
+		return nil, err
+	}
 
-		err = r.Create(ctx, cmap)
-		if err != nil {
-			logger.Error(err, "unable to create configmap")
-			return nil, err
-		}
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
 
+	if !create && !drifted(desired, cmap, desired.Data, cmap.Data) {
 		return cmap, nil
 	}
 
-	return cmap, nil
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply configmap")
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// configMapParameters are the values the page of a game is rendered with
+func (r *GameReconciler) configMapParameters(game *operatorv1beta1.Game) assets.ConfigMapParameters {
+	path := servedPath(game)
+
+	parameters := assets.ConfigMapParameters{
+		Namespace:    game.Namespace,
+		Name:         game.Name,
+		Bundle:       bundleFile(game),
+		Path:         path,
+		PathPrefix:   strings.TrimSuffix(path, "/"),
+		Title:        oneLine(game.Spec.GameName),
+		Description:  oneLine(game.Spec.Description),
+		ThumbnailUrl: game.Spec.ThumbnailUrl,
+		Byline:       byline(game),
+	}
+
+	if r.SavesImage != "" {
+		parameters.SavesPort = savesPort
+	}
+
+	if r.activated(game) {
+		parameters.StatusPort = statusPort
+	}
+
+	for _, control := range game.Spec.Controls {
+		parameters.Controls = append(parameters.Controls, assets.Control{
+			Keys:   oneLine(control.Keys),
+			Action: oneLine(control.Action),
+		})
+	}
+
+	return parameters
+}
+
+// byline sums up the publisher, the year and the genre of a game
+func byline(game *operatorv1beta1.Game) string {
+	var parts []string
+	if game.Spec.Publisher != "" {
+		parts = append(parts, oneLine(game.Spec.Publisher))
+	}
+	if game.Spec.Year != 0 {
+		parts = append(parts, strconv.Itoa(game.Spec.Year))
+	}
+	if game.Spec.Genre != "" {
+		parts = append(parts, oneLine(game.Spec.Genre))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// indexChecksum is the digest of the page of a game. It is stamped on the pod
+// template, as the page is mounted with a subPath and pods would keep serving
+// the page they started with otherwise.
+func indexChecksum(parameters assets.ConfigMapParameters) (string, error) {
+	cmap, err := assets.GetConfigMap(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.New()
+	digest.Write([]byte(cmap.Data["index.html"]))
+	digest.Write([]byte(cmap.Data["default.conf"]))
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// bundleRevision identifies the bundle of a game and the redeployment it is
+// downloaded for. A redeployment downloads the bundle again even when its
+// source did not change.
+func bundleRevision(game *operatorv1beta1.Game, redeployedAt string) string {
+	digest := sha256.Sum256([]byte(strings.Join([]string{
+		bundleSource(game),
+		strings.ToLower(game.Spec.Bundle.Sha256),
+		redeployedAt,
+	}, "\n")))
+
+	return hex.EncodeToString(digest[:8])
+}
+
+// oneLine collapses the whitespace of text, new lines included, so it fits on
+// a single line of the page of a game
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
 }
 
 func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaim(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
 	deployment *appsv1.Deployment,
 ) (*corev1.PersistentVolumeClaim, error) {
+	// the files of an ephemeral game live and die with its pod
+	if game.Spec.Persistence.Mode == operatorv1beta1.PersistenceModeEmptyDir {
+		return nil, nil
+	}
+
 	create := false
 
 	pvc := &corev1.PersistentVolumeClaim{}
@@ -159,26 +367,12 @@ func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaim(
 	}
 
 	if create {
-		response, err := http.Head(game.Spec.Url)
+		size, err := r.SizeStorage(ctx, req, game)
 		if err != nil {
 			return nil, err
 		}
 
-		if response.StatusCode != http.StatusOK {
-			return nil, err
-		}
-
-		var storage metric.Bytes
-		length, err := strconv.Atoi(response.Header.Get("Content-Length"))
-		if err != nil {
-			storage = metric.Bytes(20 * 1024 * 1024)
-		}
-
-		extras := metric.Bytes(10 * 1024 * 1024)
-		storage = metric.Bytes(length)
-		mib := uint64(math.Round((storage.Mebibytes() * 0.1) + extras.Mebibytes() + storage.Mebibytes()))
-
-		pvc, err = assets.GetPersistentVolumeClaim(game.Namespace, game.Name, mib)
+		pvc, err = newPersistentVolumeClaim(game, size)
 		if err != nil {
 			logger.Error(err, "unable to parse pvc template")
 			return nil, err
@@ -190,7 +384,7 @@ func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaim(
 			return nil, err
 		}
 
-		err = r.Create(ctx, pvc)
+		err = r.apply(ctx, pvc)
 		if err != nil {
 			logger.Error(err, "unable to create pvc")
 			return nil, err
@@ -199,20 +393,104 @@ func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaim(
 		return pvc, nil
 	}
 
+	// the spec of a claim is immutable apart from its storage request, so
+	// render the desired claim the way it was provisioned and only patch
+	// metadata drift
+	parameters := assets.PersistentVolumeClaimParameters{
+		Namespace:   game.Namespace,
+		Name:        game.Name,
+		Storage:     storageMebibytes(pvc),
+		AccessModes: pvc.Spec.AccessModes,
+	}
+
+	if pvc.Spec.StorageClassName != nil {
+		parameters.StorageClassName = *pvc.Spec.StorageClassName
+	}
+
+	if pvc.Spec.VolumeMode != nil {
+		parameters.VolumeMode = *pvc.Spec.VolumeMode
+	}
+
+	desired, err := assets.GetPersistentVolumeClaim(parameters)
+	if err != nil {
+		logger.Error(err, "unable to parse pvc template")
+		return nil, err
+	}
+
+	for _, annotation := range []string{bundleSizeAnnotation, bundleSourceAnnotation} {
+		if value, ok := pvc.Annotations[annotation]; ok {
+			if desired.Annotations == nil {
+				desired.Annotations = map[string]string{}
+			}
+			desired.Annotations[annotation] = value
+		}
+	}
+
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
+
+	if !drifted(desired, pvc, nil, nil) {
+		return pvc, nil
+	}
+
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply pvc")
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// newPersistentVolumeClaim renders the claim of a game with the given size,
+// annotated with the bundle it was sized for
+func newPersistentVolumeClaim(game *operatorv1beta1.Game, size *StorageSize) (*corev1.PersistentVolumeClaim, error) {
+	parameters := assets.PersistentVolumeClaimParameters{
+		Namespace:   game.Namespace,
+		Name:        game.Name,
+		Storage:     size.Mebibytes,
+		AccessModes: game.Spec.Persistence.AccessModes,
+	}
+
+	if game.Spec.Persistence.StorageClassName != nil {
+		parameters.StorageClassName = *game.Spec.Persistence.StorageClassName
+	}
+
+	if game.Spec.Persistence.VolumeMode != nil {
+		parameters.VolumeMode = *game.Spec.Persistence.VolumeMode
+	}
+
+	pvc, err := assets.GetPersistentVolumeClaim(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+
+	pvc.Annotations[bundleSourceAnnotation] = bundleSource(game)
+	if size.BundleLength > 0 {
+		pvc.Annotations[bundleSizeAnnotation] = strconv.FormatInt(size.BundleLength, 10)
+	}
+
 	return pvc, nil
 }
 
 func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaimAssets(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
 ) (*corev1.PersistentVolumeClaim, error) {
 	create := false
 
 	pvc := &corev1.PersistentVolumeClaim{}
 	objectKey := client.ObjectKey{
 		Namespace: req.Namespace,
-		Name:      fmt.Sprintf("%s-pvc", "kube-dosbox-assets"),
+		Name:      defaultAssetsClaim,
 	}
 	err := r.Get(ctx, objectKey, pvc)
 	if err != nil {
@@ -225,38 +503,18 @@ func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaimAssets(
 	}
 
 	if create {
-		response, err := http.Head(game.Spec.Url)
-		if err != nil {
-			return nil, err
-		}
-
-		if response.StatusCode != http.StatusOK {
-			return nil, err
-		}
-
-		var storage metric.Bytes
-		length, err := strconv.Atoi(response.Header.Get("Content-Length"))
-		if err != nil {
-			storage = metric.Bytes(20 * 1024 * 1024)
-		}
-
-		extras := metric.Bytes(10 * 1024 * 1024)
-		storage = metric.Bytes(length)
-		mib := uint64(math.Round((storage.Mebibytes() * 0.1) + extras.Mebibytes() + storage.Mebibytes()))
-
-		pvc, err = assets.GetPersistentVolumeClaimAssets(game.Namespace, game.Name, mib)
+		// the claim holds the emulator assets of the namespace, whatever the
+		// size of the bundles of its games
+		pvc, err = assets.GetPersistentVolumeClaimAssets(game.Namespace, game.Name, defaultAssetsMebibytes)
 		if err != nil {
 			logger.Error(err, "unable to parse pvc template")
 			return nil, err
 		}
 
-		//err = ctrl.SetControllerReference(deployment, pvc, r.Scheme)
-		//if err != nil {
-		//	logger.Error(err, "unable to set controller reference")
-		//	return nil, err
-		//}
+		// the assets are shared by all the games of the namespace, so the pvc
+		// has no owner and is removed by the finalizer of the last game instead
 
-		err = r.Create(ctx, pvc)
+		err = r.apply(ctx, pvc)
 		if err != nil {
 			logger.Error(err, "unable to create pvc")
 			return nil, err
@@ -265,13 +523,36 @@ func (r *GameReconciler) CreateOrUpdatePersistentVolumeClaimAssets(
 		return pvc, nil
 	}
 
-	return pvc, nil
+	// same as the game claim, only metadata can be patched in place
+	desired, err := assets.GetPersistentVolumeClaimAssets(game.Namespace, game.Name, storageMebibytes(pvc))
+	if err != nil {
+		logger.Error(err, "unable to parse pvc template")
+		return nil, err
+	}
+
+	if !drifted(desired, pvc, nil, nil) {
+		return pvc, nil
+	}
+
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply pvc")
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// storageMebibytes returns the storage requested by the claim in MiB
+func storageMebibytes(pvc *corev1.PersistentVolumeClaim) uint64 {
+	storage := pvc.Spec.Resources.Requests.Storage()
+	return uint64(metric.Bytes(storage.Value()).Mebibytes())
 }
 
 func (r *GameReconciler) CreateOrUpdateService(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
+	game *operatorv1beta1.Game,
 	deployment *appsv1.Deployment,
 ) (*corev1.Service, error) {
 	create := false
@@ -287,47 +568,37 @@ func (r *GameReconciler) CreateOrUpdateService(
 		}
 	}
 
-	if create {
-		svc, err = assets.GetService(game.Namespace, game.Name, game.Spec.Port)
-		if err != nil {
-			logger.Error(err, "unable to parse svc template")
-			return nil, err
-		}
-
-		err = ctrl.SetControllerReference(deployment, svc, r.Scheme)
-		if err != nil {
-			logger.Error(err, "unable to set controller reference")
-			return nil, err
-		}
+	desired, err := assets.GetService(assets.ServiceParameters{
+		Namespace: game.Namespace,
+		Name:      game.Name,
+		Port:      game.Spec.Exposure.Port,
+		Type:      serviceType(game.Spec.Exposure.Type),
+		NodePort:  game.Spec.Exposure.NodePort,
+		Activator: r.activated(game),
+	})
+	if err != nil {
+		logger.Error(err, "unable to parse svc template")
+		return nil, err
+	}
 
-		err = r.Create(ctx, svc)
-		if err != nil {
-			logger.Error(err, "unable to create svc")
-			return nil, err
-		}
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
 
+	// the selector is left out of the desired service of a game behind the
+	// activator, so dropping it does not count as drift by itself
+	selected := len(desired.Spec.Selector) > 0
+	if !create && !drifted(desired, svc, desired.Spec, svc.Spec) && selected == (len(svc.Spec.Selector) > 0) {
 		return svc, nil
 	}
 
-	svcPort := svc.Spec.Ports[0].Port
-	specPort := int32(game.Spec.Port)
-
-	if svcPort != specPort {
-		dc := svc.DeepCopy()
-		dc.Spec.Ports[0].Port = specPort
-
-		err = ctrl.SetControllerReference(game, deployment, r.Scheme)
-		if err != nil {
-			logger.Error(err, "unable to set controller reference")
-			return nil, err
-		}
-
-		err = r.Update(ctx, dc)
-		if err != nil {
-			logger.Error(err, "unable to update svc")
-			return nil, err
-		}
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply svc")
+		return nil, err
 	}
 
-	return svc, nil
+	return desired, nil
 }
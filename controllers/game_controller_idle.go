@@ -0,0 +1,599 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// activatorLabel is stamped on the endpoints the controller keeps for the
+	// service of a game with spec.idle
+	activatorLabel = "dosbox.contrib/activator"
+
+	// lastRequestAnnotation is stamped on a game with spec.idle with when it
+	// was last requested, so its activity outlives restarts of the manager
+	lastRequestAnnotation = "dosbox.contrib/last-request"
+
+	// activityInterval is how often the request count of a running game with
+	// spec.idle is read, and at most how often its activity is written
+	activityInterval = time.Minute
+
+	// statusPort is the port the engine of a game with spec.idle reports its
+	// request count at, and statusTimeout how long it has to answer
+	statusPort    = 8081
+	statusTimeout = 2 * time.Second
+
+	// podIPField indexes pods by their address, to tell the namespace of the
+	// clients of the activator
+	podIPField = "status.podIP"
+
+	// defaultActivatorTimeout is how long the activator holds a request for a
+	// game that is not ready yet, unless the activator sets Timeout
+	defaultActivatorTimeout = 5 * time.Minute
+
+	// activatorPollInterval is how often the activator checks whether a game
+	// it holds a request for is ready
+	activatorPollInterval = time.Second
+)
+
+// Activator sits in front of the games with spec.idle that are not ready.
+// Their services send their requests to it while they are scaled to zero or
+// starting, and to their pods once they are ready. It holds the requests
+// while a game is started again, and forwards them to its pod once it is.
+//
+// Requests are told apart by the address the client asked for: the name of
+// the service of a game, the host and the path of its status.url, or its node
+// port. The bare name of a service only resolves for clients in the namespace
+// of the game. Requests a running game serves itself are counted by its pod.
+// When a game was last requested is written to the game, so that a restart of
+// the manager does not count as activity.
+type Activator struct {
+	// Addr is the address the activator listens at
+	Addr string
+	// Ip is the address of the manager pod the services of idle games send
+	// their requests to
+	Ip string
+	// Timeout is how long a request is held for a game that is not ready
+	Timeout time.Duration
+
+	reconciler *GameReconciler
+	wake       chan event.GenericEvent
+	mutex      sync.Mutex
+	activity   map[types.NamespacedName]time.Time
+	written    map[types.NamespacedName]time.Time
+	counts     map[types.NamespacedName]requestCount
+}
+
+// requestCount is the number of requests a pod of a game served
+type requestCount struct {
+	address  string
+	requests int64
+}
+
+// setup hooks the activator to the game controller, which it reads the
+// status of the games with and asks to start games scaled to zero
+func (a *Activator) setup(r *GameReconciler) {
+	a.reconciler = r
+	a.wake = make(chan event.GenericEvent, 64)
+	a.activity = map[types.NamespacedName]time.Time{}
+	a.written = map[types.NamespacedName]time.Time{}
+	a.counts = map[types.NamespacedName]requestCount{}
+}
+
+// Port returns the port the activator listens at
+func (a *Activator) Port() (int32, error) {
+	_, port, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		return 0, err
+	}
+
+	number, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(number), nil
+}
+
+// LastRequest returns when a game was last requested, or when it was created
+// if it never was
+func (a *Activator) LastRequest(game *operatorv1beta1.Game) time.Time {
+	last := game.CreationTimestamp.Time
+	if written, err := time.Parse(time.RFC3339, game.Annotations[lastRequestAnnotation]); err == nil && written.After(last) {
+		last = written
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if at, ok := a.activity[client.ObjectKeyFromObject(game)]; ok && at.After(last) {
+		last = at
+	}
+
+	return last
+}
+
+// record keeps when a game was requested, and writes it to the game at most
+// once every activityInterval
+func (a *Activator) record(ctx context.Context, game *operatorv1beta1.Game, at time.Time) error {
+	key := client.ObjectKeyFromObject(game)
+
+	a.mutex.Lock()
+	if at.After(a.activity[key]) {
+		a.activity[key] = at
+	}
+
+	written := a.written[key]
+	if annotated, err := time.Parse(time.RFC3339, game.Annotations[lastRequestAnnotation]); err == nil && annotated.After(written) {
+		written = annotated
+	}
+
+	if at.Sub(written) < activityInterval {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.written[key] = at
+	a.mutex.Unlock()
+
+	patch := client.MergeFrom(game.DeepCopy())
+	if game.Annotations == nil {
+		game.Annotations = map[string]string{}
+	}
+	game.Annotations[lastRequestAnnotation] = at.UTC().Format(time.RFC3339)
+
+	return a.reconciler.Patch(ctx, game, patch)
+}
+
+// played reports whether the pod of a game served requests since its count
+// was last read. Reading the count is a request of its own, and a count of
+// another pod, or of a restarted one, only sets the baseline.
+func (a *Activator) played(game *operatorv1beta1.Game, address string, requests int64) bool {
+	key := client.ObjectKeyFromObject(game)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	previous, ok := a.counts[key]
+	a.counts[key] = requestCount{address: address, requests: requests}
+
+	return ok && previous.address == address && requests > previous.requests+1
+}
+
+// requests reads the number of requests the engine at the address served
+func (a *Activator) requests(ctx context.Context, address string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("http://%s/stub_status", net.JoinHostPort(address, strconv.Itoa(statusPort)))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to read request count: %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return 0, err
+	}
+
+	return stubStatusRequests(string(body))
+}
+
+// stubStatusRequests returns the request count of a page of the nginx
+// stub_status module:
+//
+//	Active connections: 1
+//	server accepts handled requests
+//	 7 7 42
+//	Reading: 0 Writing: 1 Waiting: 0
+func stubStatusRequests(page string) (int64, error) {
+	lines := strings.Split(page, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "server accepts handled requests" || i+1 >= len(lines) {
+			continue
+		}
+
+		counts := strings.Fields(lines[i+1])
+		if len(counts) != 3 {
+			break
+		}
+
+		return strconv.ParseInt(counts[2], 10, 64)
+	}
+
+	return 0, fmt.Errorf("unable to read request count: unexpected stub_status page")
+}
+
+// Start implements manager.Runnable
+func (a *Activator) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              a.Addr,
+		Handler:           a,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Activity is
+// kept by the replica of the manager reconciling the games, which the
+// endpoints of their services point at.
+func (a *Activator) NeedLeaderElection() bool {
+	return true
+}
+
+// ServeHTTP records the request as activity of the game it is meant for and
+// forwards it to a ready pod of the game, once there is one
+func (a *Activator) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	log := log.FromContext(request.Context()).WithName("activator")
+
+	game, err := a.resolve(request.Context(), request)
+	if err != nil {
+		log.Error(err, "unable to list games")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if game == nil {
+		http.Error(w, "no game is served at this address", http.StatusNotFound)
+		return
+	}
+
+	if game.Spec.Suspend {
+		http.Error(w, fmt.Sprintf("%s is suspended", game.Spec.GameName), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := a.record(request.Context(), game, time.Now()); err != nil {
+		log.Error(err, "unable to record activity", "game", client.ObjectKeyFromObject(game))
+	}
+
+	address, err := a.await(request.Context(), game)
+	if err != nil {
+		log.Error(err, "game did not get ready", "game", client.ObjectKeyFromObject(game))
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, fmt.Sprintf("%s is starting, try again shortly", game.Spec.GameName), http.StatusServiceUnavailable)
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: net.JoinHostPort(address, "80")})
+	proxy.ServeHTTP(w, request)
+}
+
+// await returns the address of a ready pod of the game, asking the
+// controller to start the game if there is none, and waiting for the pod
+// until the request is cancelled or times out
+func (a *Activator) await(ctx context.Context, game *operatorv1beta1.Game) (string, error) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultActivatorTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(game)}
+	woken := false
+
+	for {
+		observation, err := a.reconciler.GetStatus(ctx, req, game.Name)
+		if err != nil {
+			return "", err
+		}
+
+		if observation.Ready && observation.Address != "" {
+			return observation.Address, nil
+		}
+
+		if !woken {
+			select {
+			case a.wake <- event.GenericEvent{Object: game}:
+				woken = true
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(activatorPollInterval):
+		}
+	}
+}
+
+// resolve finds the idle game a request is meant for. The name of the
+// service of a game wins over its exposure, and of the games exposed at the
+// same host the one with the longest path matching the request does.
+func (a *Activator) resolve(ctx context.Context, request *http.Request) (*operatorv1beta1.Game, error) {
+	games := &operatorv1beta1.GameList{}
+	if err := a.reconciler.List(ctx, games); err != nil {
+		return nil, err
+	}
+
+	host, port := request.Host, ""
+	if h, p, err := net.SplitHostPort(request.Host); err == nil {
+		host, port = h, p
+	}
+	host = strings.ToLower(host)
+
+	// the bare name of a service is what clients in the namespace of the
+	// game ask for
+	namespace := ""
+	if !strings.Contains(host, ".") {
+		var err error
+		namespace, err = a.clientNamespace(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var found *operatorv1beta1.Game
+	longest := -1
+
+	for i := range games.Items {
+		game := &games.Items[i]
+		if game.Spec.Idle == nil || !game.Spec.Deploy || !game.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		service := fmt.Sprintf("%s.%s", game.Name, game.Namespace)
+		if host == service || host == service+".svc" || strings.HasPrefix(host, service+".svc.") {
+			return game, nil
+		}
+
+		path := servedPath(game)
+		if !strings.HasPrefix(request.URL.Path+"/", path) || len(path) <= longest {
+			continue
+		}
+
+		exposed, err := url.Parse(game.Status.URL)
+		if err != nil {
+			continue
+		}
+
+		// any node forwards the node port of the game
+		matches := namespace == game.Namespace && host == game.Name
+		switch game.Spec.Exposure.Type {
+		case operatorv1beta1.ExposureTypeNodePort:
+			matches = matches || (port != "" && port == exposed.Port())
+		case operatorv1beta1.ExposureTypeLoadBalancer, operatorv1beta1.ExposureTypeIngress, operatorv1beta1.ExposureTypeHTTPRoute:
+			matches = matches || host == strings.ToLower(exposed.Hostname())
+		}
+
+		if matches {
+			found = game
+			longest = len(path)
+		}
+	}
+
+	return found, nil
+}
+
+// clientNamespace returns the namespace of the pod a request comes from, or
+// nothing if it does not come from a pod of its own
+func (a *Activator) clientNamespace(ctx context.Context, request *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return "", nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := a.reconciler.List(ctx, pods, client.MatchingFields{podIPField: ip}); err != nil {
+		return "", err
+	}
+
+	for _, pod := range pods.Items {
+		if !pod.Spec.HostNetwork && pod.DeletionTimestamp.IsZero() {
+			return pod.Namespace, nil
+		}
+	}
+
+	return "", nil
+}
+
+// podIP indexes pods by their address
+func podIP(object client.Object) []string {
+	pod, ok := object.(*corev1.Pod)
+	if !ok || pod.Status.PodIP == "" {
+		return nil
+	}
+
+	return []string{pod.Status.PodIP}
+}
+
+// Idle reports whether a game with spec.idle went without requests for
+// longer than it allows, and otherwise how long it has left before it does.
+// The request count of a running game is read again by then, or within
+// activityInterval, whichever comes first.
+func (r *GameReconciler) Idle(ctx context.Context, req ctrl.Request, game *operatorv1beta1.Game) (bool, time.Duration) {
+	if !r.activated(game) {
+		return false, 0
+	}
+
+	// the requests a running game serves never reach the activator
+	running := false
+	observation, err := r.GetStatus(ctx, req, game.Name)
+	if err == nil && observation.Ready && observation.Address != "" {
+		running = true
+
+		requests, err := r.Activator.requests(ctx, observation.Address)
+		switch {
+		case err != nil:
+			logger.V(5).Error(err, "unable to read request count")
+		case r.Activator.played(game, observation.Address, requests):
+			if err := r.Activator.record(ctx, game, time.Now()); err != nil {
+				logger.Error(err, "unable to record activity")
+			}
+		}
+	}
+
+	timeout := time.Duration(game.Spec.Idle.Minutes) * time.Minute
+	left := timeout - time.Since(r.Activator.LastRequest(game))
+	if left <= 0 {
+		return true, 0
+	}
+
+	if running && left > activityInterval {
+		left = activityInterval
+	}
+
+	return false, left
+}
+
+// CreateOrUpdateEndpoints points the service of a game with spec.idle at its
+// ready pod, or at the activator while there is none or the game is stopped.
+// The endpoints of any other game are left to the cluster, as their services
+// select the pods of the game, and endpoints left over from the activator are
+// removed.
+func (r *GameReconciler) CreateOrUpdateEndpoints(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+	deployment *appsv1.Deployment,
+	stopped bool,
+) error {
+	create := false
+
+	endpoints := &corev1.Endpoints{}
+	err := r.Get(ctx, req.NamespacedName, endpoints)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			create = true
+		} else {
+			logger.V(5).Error(err, "unable to fetch endpoints")
+			return err
+		}
+	}
+
+	if !r.activated(game) {
+		if create || endpoints.Labels[activatorLabel] == "" {
+			return nil
+		}
+
+		err := r.Delete(ctx, endpoints)
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete endpoints")
+			return err
+		}
+
+		return nil
+	}
+
+	ip, port, err := r.endpointsAddress(ctx, req, game, stopped)
+	if err != nil {
+		return err
+	}
+
+	desired, err := assets.GetEndpoints(assets.EndpointsParameters{
+		Namespace: game.Namespace,
+		Name:      game.Name,
+		Ip:        ip,
+		Port:      port,
+	})
+	if err != nil {
+		logger.Error(err, "unable to parse endpoints template")
+		return err
+	}
+
+	err = ctrl.SetControllerReference(deployment, desired, r.Scheme)
+	if err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return err
+	}
+
+	if !create && !drifted(desired, endpoints, desired.Subsets, endpoints.Subsets) {
+		return nil
+	}
+
+	err = r.apply(ctx, desired)
+	if err != nil {
+		logger.Error(err, "unable to apply endpoints")
+		return err
+	}
+
+	return nil
+}
+
+// endpointsAddress returns where the service of a game with spec.idle sends
+// its requests: to the ready pod of the game, or to the activator while there
+// is none or the game is stopped
+func (r *GameReconciler) endpointsAddress(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+	stopped bool,
+) (string, int32, error) {
+	if !stopped {
+		observation, err := r.GetStatus(ctx, req, game.Name)
+		if err != nil {
+			logger.V(5).Error(err, "unable to fetch pod status")
+			return "", 0, err
+		}
+
+		if observation.Ready && observation.Address != "" {
+			return observation.Address, 80, nil
+		}
+	}
+
+	port, err := r.Activator.Port()
+	if err != nil {
+		logger.Error(err, "unable to parse activator address")
+		return "", 0, err
+	}
+
+	return r.Activator.Ip, port, nil
+}
+
+// activated reports whether the requests of a game go through the activator
+func (r *GameReconciler) activated(game *operatorv1beta1.Game) bool {
+	return game.Spec.Idle != nil && r.Activator != nil
+}
+
+// idleReason is the reason of the Idle condition of a game with spec.idle
+func (r *GameReconciler) idleReason(idle bool) string {
+	switch {
+	case r.Activator == nil:
+		return "ActivatorDisabled"
+	case idle:
+		return "NoTraffic"
+	default:
+		return "Active"
+	}
+}
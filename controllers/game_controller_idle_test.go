@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestActivatorResolve(t *testing.T) {
+	idle := &operatorv1beta1.IdleSpec{Minutes: 10}
+	game := func(namespace string, name string, exposure operatorv1beta1.ExposureSpec, url string) client.Object {
+		return &operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       operatorv1beta1.GameSpec{Deploy: true, Idle: idle, Exposure: exposure},
+			Status:     operatorv1beta1.GameStatus{URL: url},
+		}
+	}
+	player := func(namespace string, ip string) client.Object {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "player", Namespace: namespace},
+			Status:     corev1.PodStatus{PodIP: ip},
+		}
+	}
+
+	objects := []client.Object{
+		game("arcade", "doom", operatorv1beta1.ExposureSpec{Port: 8080, Type: operatorv1beta1.ExposureTypeClusterIP}, "http://doom.arcade.svc:8080"),
+		game("lobby", "doom", operatorv1beta1.ExposureSpec{Port: 8080, Type: operatorv1beta1.ExposureTypeClusterIP}, "http://doom.lobby.svc:8080"),
+		game("arcade", "keen", operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeNodePort}, "http://203.0.113.12:30080/"),
+		game("arcade", "prince", operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeIngress, Path: "/prince"}, "https://arcade.example.com/prince/"),
+		game("arcade", "arcade", operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeIngress, Path: "/"}, "https://arcade.example.com/"),
+		// not behind the activator
+		&operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "wolf3d", Namespace: "arcade"},
+			Spec:       operatorv1beta1.GameSpec{Deploy: true},
+		},
+		player("arcade", "10.1.0.7"),
+		player("lobby", "10.1.0.8"),
+	}
+
+	r := newFakeReconciler(objects...)
+	r.Activator = &Activator{Addr: ":8083", Ip: "10.0.0.5"}
+	r.Activator.setup(r)
+
+	for _, tc := range []struct {
+		url    string
+		remote string
+		want   string
+	}{
+		{url: "http://doom.arcade.svc.cluster.local:8080/", want: "arcade/doom"},
+		{url: "http://doom.lobby.svc:8080/", want: "lobby/doom"},
+		{url: "http://doom:8080/doom.jsdos", remote: "10.1.0.7:40000", want: "arcade/doom"},
+		{url: "http://doom:8080/doom.jsdos", remote: "10.1.0.8:40000", want: "lobby/doom"},
+		// a bare name from outside of any namespace is nobody's
+		{url: "http://doom:8080/doom.jsdos", remote: "10.1.0.9:40000"},
+		{url: "http://10.0.0.11:30080/", want: "arcade/keen"},
+		{url: "http://arcade.example.com/prince/assets/wdosbox.js", want: "arcade/prince"},
+		{url: "http://arcade.example.com/princess", want: "arcade/arcade"},
+		{url: "http://wolf3d.arcade.svc:80/"},
+		{url: "http://elsewhere.example.com/prince/"},
+	} {
+		request := httptest.NewRequest("GET", tc.url, nil)
+		if tc.remote != "" {
+			request.RemoteAddr = tc.remote
+		}
+
+		found, err := r.Activator.resolve(context.Background(), request)
+		if err != nil {
+			t.Fatalf("%s: resolving: %v", tc.url, err)
+		}
+
+		name := ""
+		if found != nil {
+			name = found.Namespace + "/" + found.Name
+		}
+
+		if name != tc.want {
+			t.Errorf("%s from %s resolves to %q, expected %q", tc.url, request.RemoteAddr, name, tc.want)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "arcade", Name: "doom"}}
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "doom",
+			Namespace:         "arcade",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-11 * time.Minute)),
+		},
+		Spec: operatorv1beta1.GameSpec{Idle: &operatorv1beta1.IdleSpec{Minutes: 10}},
+	}
+
+	r := newFakeReconciler(game)
+	r.Activator = &Activator{Addr: ":8083", Ip: "10.0.0.5"}
+	r.Activator.setup(r)
+
+	// nobody played the game since it was created
+	if idle, _ := r.Idle(ctx, req, game); !idle {
+		t.Errorf("game is not idle after 11 minutes without requests")
+	}
+
+	if err := r.Activator.record(ctx, game, time.Now()); err != nil {
+		t.Fatalf("recording activity: %v", err)
+	}
+
+	// a restart of the manager does not forget the request
+	r.Activator.setup(r)
+	stored := &operatorv1beta1.Game{}
+	if err := r.Get(ctx, req.NamespacedName, stored); err != nil {
+		t.Fatalf("fetching game: %v", err)
+	}
+
+	if idle, left := r.Idle(ctx, req, stored); idle || left <= 9*time.Minute {
+		t.Errorf("game is idle (%t) or idles in %s right after a request", idle, left)
+	}
+
+	// activity is written at most once every activityInterval
+	written := stored.Annotations[lastRequestAnnotation]
+	if err := r.Activator.record(ctx, stored, time.Now().Add(30*time.Second)); err != nil {
+		t.Fatalf("recording activity: %v", err)
+	}
+	if stored.Annotations[lastRequestAnnotation] != written {
+		t.Errorf("activity is written again after 30 seconds")
+	}
+
+	for _, tc := range []struct {
+		address  string
+		requests int64
+		played   bool
+	}{
+		{address: "10.1.0.4", requests: 10},
+		// the count grows by the read of the controller itself
+		{address: "10.1.0.4", requests: 11},
+		{address: "10.1.0.4", requests: 15, played: true},
+		// another pod only sets the baseline
+		{address: "10.1.0.6", requests: 40},
+		// and so does a restarted one
+		{address: "10.1.0.6", requests: 3},
+		{address: "10.1.0.6", requests: 5, played: true},
+	} {
+		if played := r.Activator.played(game, tc.address, tc.requests); played != tc.played {
+			t.Errorf("%d requests at %s are played (%t), expected %t", tc.requests, tc.address, played, tc.played)
+		}
+	}
+
+	requests, err := stubStatusRequests("Active connections: 1 \nserver accepts handled requests\n 7 7 42 \nReading: 0 Writing: 1 Waiting: 0 \n")
+	if err != nil || requests != 42 {
+		t.Errorf("stub_status counts %d requests (%v), expected 42", requests, err)
+	}
+
+	svc, err := assets.GetService(assets.ServiceParameters{
+		Namespace: game.Namespace,
+		Name:      game.Name,
+		Port:      80,
+		Type:      corev1.ServiceTypeClusterIP,
+		Activator: r.activated(game),
+	})
+	if err != nil || len(svc.Spec.Selector) > 0 {
+		t.Errorf("service of an idle game selects %v (%v), expected the activator endpoints", svc.Spec.Selector, err)
+	}
+}
+
+func TestIdleEndpoints(t *testing.T) {
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "arcade", Name: "doom"}}
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameSpec{
+			Idle:     &operatorv1beta1.IdleSpec{Minutes: 10},
+			Exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeClusterIP},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom-0", Namespace: "arcade", Labels: map[string]string{"app": "doom"}},
+		Status: corev1.PodStatus{
+			PodIP: "10.1.0.4",
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "doom-init-bundle", Ready: true},
+			},
+		},
+	}
+
+	r := newFakeReconciler(game, pod)
+	r.Activator = &Activator{Addr: ":8083", Ip: "10.0.0.5"}
+	r.Activator.setup(r)
+
+	for _, tc := range []struct {
+		ready   bool
+		stopped bool
+		ip      string
+		port    int32
+	}{
+		{ip: "10.0.0.5", port: 8083},
+		// a ready game serves its requests itself
+		{ready: true, ip: "10.1.0.4", port: 80},
+		// and a game being stopped does not anymore
+		{ready: true, stopped: true, ip: "10.0.0.5", port: 8083},
+	} {
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "doom-engine", Ready: tc.ready}}
+		if err := r.Status().Update(ctx, pod); err != nil {
+			t.Fatalf("updating pod: %v", err)
+		}
+
+		ip, port, err := r.endpointsAddress(ctx, req, game, tc.stopped)
+		if err != nil {
+			t.Fatalf("finding endpoints: %v", err)
+		}
+
+		if ip != tc.ip || port != tc.port {
+			t.Errorf("endpoints of a game ready (%t) and stopped (%t) are %s:%d, expected %s:%d", tc.ready, tc.stopped, ip, port, tc.ip, tc.port)
+		}
+	}
+}
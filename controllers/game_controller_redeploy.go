@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+const (
+	// redeployAtAnnotation holds an RFC3339 timestamp. Whenever it is later
+	// than status.lastRedeployTime the game is rolled out again, as soon as
+	// that time has been reached.
+	redeployAtAnnotation = "dosbox.contrib/redeploy-at"
+)
+
+// Redeploy records a new status.lastRedeployTime when either spec.forceRedeploy
+// is set or the redeploy-at annotation asks for it, which in turn changes the
+// pod template and rolls out a fresh pod. It returns how long to wait for a
+// redeploy that is scheduled in the future.
+func (r *GameReconciler) Redeploy(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (time.Duration, error) {
+	now := time.Now()
+
+	redeploy := game.Spec.ForceRedeploy
+	scheduled := time.Duration(0)
+
+	if value, ok := game.Annotations[redeployAtAnnotation]; ok {
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("ignoring invalid %s annotation", redeployAtAnnotation))
+		}
+
+		// status.lastRedeployTime is stored with second precision
+		at = at.Truncate(time.Second)
+
+		if err == nil && (game.Status.LastRedeployTime == nil || at.After(game.Status.LastRedeployTime.Time)) {
+			if at.After(now) {
+				scheduled = at.Sub(now)
+			} else {
+				redeploy = true
+			}
+		}
+	}
+
+	if !redeploy {
+		return scheduled, nil
+	}
+
+	patch := client.MergeFrom(game.DeepCopy())
+	game.Status.LastRedeployTime = &metav1.Time{Time: now}
+
+	err := r.Status().Patch(ctx, game, patch)
+	if err != nil {
+		logger.V(5).Error(err, "unable to patch game status")
+		return 0, err
+	}
+
+	if game.Spec.ForceRedeploy {
+		patch = client.MergeFrom(game.DeepCopy())
+		game.Spec.ForceRedeploy = false
+
+		err = r.Patch(ctx, game, patch)
+		if err != nil {
+			logger.Error(err, "unable to reset forceRedeploy")
+			return 0, err
+		}
+	}
+
+	logger.Info(fmt.Sprintf("%s is redeployed", strings.ToLower(game.Name)))
+
+	return scheduled, nil
+}
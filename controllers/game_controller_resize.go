@@ -0,0 +1,382 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+)
+
+const (
+	// bundleSourceAnnotation is stamped on the claim of a game with the bundle
+	// it was sized for
+	bundleSourceAnnotation = "dosbox.contrib/bundle-source"
+)
+
+//+kubebuilder:rbac:groups="storage.k8s.io",resources=storageclasses,verbs=get;list;watch
+
+// ResizeStorage grows the claim of a game whose bundle changed and no longer
+// fits on it. Claims of a storage class allowing volume expansion are expanded
+// in place. Any other claim is recreated: the game is stopped, its files are
+// copied to a temporary claim, the claim is recreated with the new size and
+// the files are copied back. It returns true as long as the game has to stay
+// stopped. Progress is reported in the StorageReady condition.
+func (r *GameReconciler) ResizeStorage(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (bool, error) {
+	if game.Spec.Persistence.Mode == operatorv1beta1.PersistenceModeEmptyDir {
+		return false, nil
+	}
+
+	pvc, err := r.getPersistentVolumeClaim(ctx, req.Namespace, fmt.Sprintf("%s-pvc", req.Name))
+	if err != nil {
+		return false, err
+	}
+
+	temp, err := r.getPersistentVolumeClaim(ctx, req.Namespace, migrationClaim(req.Name))
+	if err != nil {
+		return false, err
+	}
+
+	if temp != nil {
+		return r.migrate(ctx, req, game, pvc, temp)
+	}
+
+	if pvc == nil || !pvc.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+
+	if pvc.Annotations[bundleSourceAnnotation] == bundleSource(game) {
+		return false, r.expanded(ctx, game, pvc)
+	}
+
+	size, err := r.SizeStorage(ctx, req, game)
+	if err != nil {
+		return false, err
+	}
+
+	current := storageMebibytes(pvc)
+	if size.Mebibytes > current {
+		expandable, err := r.expandable(ctx, pvc)
+		if err != nil {
+			return false, err
+		}
+
+		if !expandable {
+			temp, err := r.backup(ctx, game, size, current)
+			if err != nil {
+				return false, err
+			}
+
+			return r.migrate(ctx, req, game, pvc, temp)
+		}
+	}
+
+	patch := client.MergeFrom(pvc.DeepCopy())
+
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+
+	pvc.Annotations[bundleSourceAnnotation] = bundleSource(game)
+	delete(pvc.Annotations, bundleSizeAnnotation)
+	if size.BundleLength > 0 {
+		pvc.Annotations[bundleSizeAnnotation] = strconv.FormatInt(size.BundleLength, 10)
+	}
+
+	if size.Mebibytes > current {
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = *resource.NewQuantity(int64(size.Mebibytes)*1024*1024, resource.BinarySI)
+	}
+
+	if err := r.Patch(ctx, pvc, patch); err != nil {
+		logger.Error(err, "unable to patch pvc")
+		return false, err
+	}
+
+	if size.Mebibytes <= current {
+		return false, nil
+	}
+
+	logger.Info(fmt.Sprintf("%s storage is expanded from %dMi to %dMi", strings.ToLower(game.Name), current, size.Mebibytes))
+
+	return false, r.setStorageCondition(ctx, game, storageCondition(game, "Expanding",
+		fmt.Sprintf("expanding storage from %dMi to %dMi", current, size.Mebibytes)))
+}
+
+// expanded marks the expansion of a claim as done, once its capacity caught
+// up with its request
+func (r *GameReconciler) expanded(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	pvc *corev1.PersistentVolumeClaim,
+) error {
+	condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionStorageReady)
+	if condition == nil || condition.Reason != "Expanding" {
+		return nil
+	}
+
+	capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]
+	if !ok || capacity.Cmp(*pvc.Spec.Resources.Requests.Storage()) < 0 {
+		return nil
+	}
+
+	expanded := storageCondition(game, "Expanded", fmt.Sprintf("storage is expanded to %s", capacity.String()))
+	expanded.Status = metav1.ConditionTrue
+
+	return r.setStorageCondition(ctx, game, expanded)
+}
+
+// expandable reports whether the storage class of a claim allows expanding it
+func (r *GameReconciler) expandable(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+
+	class := &storagev1.StorageClass{}
+	if err := r.Get(ctx, client.ObjectKey{Name: *pvc.Spec.StorageClassName}, class); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		logger.V(5).Error(err, "unable to fetch storage class")
+		return false, err
+	}
+
+	return class.AllowVolumeExpansion != nil && *class.AllowVolumeExpansion, nil
+}
+
+// backup starts recreating the claim of a game, whose storage class does not
+// allow expanding it, with a temporary claim of the new size the files of the
+// game are backed up to
+func (r *GameReconciler) backup(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	size *StorageSize,
+	current uint64,
+) (*corev1.PersistentVolumeClaim, error) {
+	temp, err := newPersistentVolumeClaim(game, size)
+	if err != nil {
+		logger.Error(err, "unable to parse pvc template")
+		return nil, err
+	}
+
+	temp.Name = migrationClaim(game.Name)
+
+	if err := ctrl.SetControllerReference(game, temp, r.Scheme); err != nil {
+		logger.Error(err, "unable to set controller reference")
+		return nil, err
+	}
+
+	if err := r.Create(ctx, temp); err != nil {
+		logger.Error(err, "unable to create pvc")
+		return nil, err
+	}
+
+	logger.Info(fmt.Sprintf("%s storage is recreated from %dMi to %dMi", strings.ToLower(game.Name), current, size.Mebibytes))
+
+	return temp, nil
+}
+
+// migrate takes a recreation of the claim of a game one step further, which
+// step being told by the claims at hand: while the claim is smaller than the
+// temporary one the files are backed up, once it is gone it is recreated, and
+// once recreated the files are restored
+func (r *GameReconciler) migrate(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+	pvc *corev1.PersistentVolumeClaim,
+	temp *corev1.PersistentVolumeClaim,
+) (bool, error) {
+	if !temp.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+
+	switch {
+	case pvc != nil && !pvc.DeletionTimestamp.IsZero():
+		return true, nil
+
+	case pvc != nil && storageMebibytes(pvc) < storageMebibytes(temp):
+		done, err := r.migrationJob(ctx, game, "backup", pvc.Name, temp.Name)
+		if err != nil || !done {
+			return true, err
+		}
+
+		if err := r.Delete(ctx, pvc); err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "unable to delete pvc")
+			return true, err
+		}
+
+		return true, r.setStorageCondition(ctx, game, storageCondition(game, "Recreating",
+			fmt.Sprintf("recreating storage with %dMi", storageMebibytes(temp))))
+
+	case pvc == nil:
+		deployment := &appsv1.Deployment{}
+		if err := r.Get(ctx, req.NamespacedName, deployment); err != nil {
+			logger.V(5).Error(err, "unable to fetch deployment")
+			return true, err
+		}
+
+		size := &StorageSize{Mebibytes: storageMebibytes(temp)}
+		size.BundleLength, _ = strconv.ParseInt(temp.Annotations[bundleSizeAnnotation], 10, 64)
+
+		pvc, err := newPersistentVolumeClaim(game, size)
+		if err != nil {
+			logger.Error(err, "unable to parse pvc template")
+			return true, err
+		}
+
+		if err := ctrl.SetControllerReference(deployment, pvc, r.Scheme); err != nil {
+			logger.Error(err, "unable to set controller reference")
+			return true, err
+		}
+
+		if err := r.apply(ctx, pvc); err != nil {
+			logger.Error(err, "unable to create pvc")
+			return true, err
+		}
+
+		return true, nil
+
+	default:
+		done, err := r.migrationJob(ctx, game, "restore", temp.Name, pvc.Name)
+		if err != nil || !done {
+			return true, err
+		}
+
+		for _, object := range []client.Object{
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: fmt.Sprintf("%s-backup", req.Name)}},
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: fmt.Sprintf("%s-restore", req.Name)}},
+			temp,
+		} {
+			err := r.Delete(ctx, object, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrors.IsNotFound(err) {
+				logger.Error(err, "unable to clean up after migration")
+				return true, err
+			}
+		}
+
+		logger.Info(fmt.Sprintf("%s storage is recreated", strings.ToLower(game.Name)))
+
+		resized := storageCondition(game, "Resized", fmt.Sprintf("storage is recreated with %dMi", storageMebibytes(pvc)))
+		resized.Status = metav1.ConditionTrue
+
+		return false, r.setStorageCondition(ctx, game, resized)
+	}
+}
+
+// migrationJob makes sure the job of a step of a migration exists and
+// reports whether it completed. A failed job is left in place for inspection,
+// and keeps the game stopped until it is deleted.
+func (r *GameReconciler) migrationJob(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	step string,
+	from string,
+	to string,
+) (bool, error) {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: game.Namespace, Name: fmt.Sprintf("%s-%s", game.Name, step)}, job)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.V(5).Error(err, "unable to fetch job")
+			return false, err
+		}
+
+		job, err = assets.GetMigrationJob(assets.MigrationParameters{
+			Namespace: game.Namespace,
+			Name:      game.Name,
+			Step:      step,
+			From:      from,
+			To:        to,
+		})
+		if err != nil {
+			logger.Error(err, "unable to parse job template")
+			return false, err
+		}
+
+		if err := ctrl.SetControllerReference(game, job, r.Scheme); err != nil {
+			logger.Error(err, "unable to set controller reference")
+			return false, err
+		}
+
+		if err := r.Create(ctx, job); err != nil {
+			logger.Error(err, "unable to create job")
+			return false, err
+		}
+
+		reason := "BackingUp"
+		if step == "restore" {
+			reason = "Restoring"
+		}
+
+		return false, r.setStorageCondition(ctx, game, storageCondition(game, reason,
+			fmt.Sprintf("copying the files of the game from %s to %s to recreate its storage", from, to)))
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			return false, r.setStorageCondition(ctx, game, storageCondition(game, "MigrationFailed",
+				fmt.Sprintf("job %s failed: %s, delete it to try again", job.Name, condition.Message)))
+		}
+	}
+
+	return false, nil
+}
+
+func (r *GameReconciler) getPersistentVolumeClaim(
+	ctx context.Context,
+	namespace string,
+	name string,
+) (*corev1.PersistentVolumeClaim, error) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, pvc); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		logger.V(5).Error(err, "unable to fetch pvc")
+		return nil, err
+	}
+
+	return pvc, nil
+}
+
+// storageCondition is a StorageReady condition of a game whose storage is not
+// ready yet
+func storageCondition(game *operatorv1beta1.Game, reason string, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:               operatorv1beta1.ConditionStorageReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: game.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+}
+
+// migrationClaim is the temporary claim the files of a game are kept on while
+// its claim is recreated
+func migrationClaim(name string) string {
+	return fmt.Sprintf("%s-pvc-migration", name)
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestResizeStorage(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		expansion  bool
+		stopped    bool
+		reason     string
+		wantStored string
+	}{
+		{name: "expandable", expansion: true, reason: "Expanding", wantStored: "4Mi"},
+		{name: "recreated", expansion: false, stopped: true, reason: "BackingUp", wantStored: "1Mi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			class := &storagev1.StorageClass{
+				ObjectMeta:           metav1.ObjectMeta{Name: "standard"},
+				AllowVolumeExpansion: &tc.expansion,
+			}
+
+			cmap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "bundles", Namespace: "default"},
+				BinaryData: map[string][]byte{"doom.jsdos": make([]byte, 2*1024*1024)},
+			}
+
+			game := &operatorv1beta1.Game{
+				ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "default"},
+				Spec: operatorv1beta1.GameSpec{
+					Bundle: operatorv1beta1.BundleSpec{
+						ConfigMapRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: cmap.Name},
+							Key:                  "doom.jsdos",
+						},
+					},
+				},
+			}
+
+			// the claim was sized for the shareware bundle the game pointed at before
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "doom-pvc",
+					Namespace:   "default",
+					Annotations: map[string]string{bundleSourceAnnotation: "configmap:bundles/shareware.jsdos"},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName: &class.Name,
+					AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Mi")},
+					},
+				},
+			}
+
+			r := newFakeReconciler(class, cmap, game, pvc)
+			r.Sizer = StorageSizer{Headroom: 10, Reserve: 1024 * 1024}
+
+			ctx := context.Background()
+			req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(game)}
+
+			stopped, err := r.ResizeStorage(ctx, req, game)
+			if err != nil || stopped != tc.stopped {
+				t.Fatalf("resizing stops the game: %t (%v), expected %t", stopped, err, tc.stopped)
+			}
+
+			condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionStorageReady)
+			if condition == nil || condition.Reason != tc.reason {
+				t.Errorf("storage condition is %+v, expected %s", condition, tc.reason)
+			}
+
+			if err := r.Get(ctx, client.ObjectKeyFromObject(pvc), pvc); err != nil {
+				t.Fatalf("fetching pvc: %v", err)
+			}
+
+			if storage := pvc.Spec.Resources.Requests.Storage(); storage.String() != tc.wantStored {
+				t.Errorf("pvc requests %s, expected %s", storage.String(), tc.wantStored)
+			}
+
+			if !tc.stopped {
+				return
+			}
+
+			temp := &corev1.PersistentVolumeClaim{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: migrationClaim(game.Name)}, temp); err != nil {
+				t.Fatalf("migration pvc is not created: %v", err)
+			}
+
+			if storage := temp.Spec.Resources.Requests.Storage(); storage.String() != "4Mi" {
+				t.Errorf("migration pvc requests %s, expected 4Mi", storage.String())
+			}
+
+			job := &batchv1.Job{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "doom-backup"}, job); err != nil {
+				t.Fatalf("backup job is not created: %v", err)
+			}
+		})
+	}
+}
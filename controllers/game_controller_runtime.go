@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+)
+
+const (
+	// defaultAssetsClaim is the claim holding the emulator assets of the games
+	// of a namespace that do not reference a JsDosRuntime
+	defaultAssetsClaim = "kube-dosbox-assets-pvc"
+	// defaultAssetsMebibytes is the size of the claim holding the emulator
+	// assets of a namespace, in MiB
+	defaultAssetsMebibytes = 64
+)
+
+// ResolveRuntime fetches the JsDosRuntime the game references, if any, and
+// reports whether the emulator assets of the game are in place. A game whose
+// runtime is missing or still being populated is not rolled out, which is
+// recorded in its AssetsReady condition.
+func (r *GameReconciler) ResolveRuntime(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (*operatorv1beta1.JsDosRuntime, bool, error) {
+	if game.Spec.RuntimeRef == nil {
+		return nil, true, nil
+	}
+
+	jsdos := &operatorv1beta1.JsDosRuntime{}
+	err := r.Get(ctx, client.ObjectKey{Name: game.Spec.RuntimeRef.Name}, jsdos)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.V(5).Error(err, "unable to fetch runtime")
+		return nil, false, err
+	}
+
+	assetsReady := metav1.Condition{
+		Type:               operatorv1beta1.ConditionAssetsReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: game.Generation,
+		Reason:             "RuntimePopulating",
+		Message:            fmt.Sprintf("runtime %s is populating the emulator assets of namespace %s", game.Spec.RuntimeRef.Name, game.Namespace),
+	}
+
+	switch {
+	case apierrors.IsNotFound(err):
+		assetsReady.Reason = "RuntimeNotFound"
+		assetsReady.Message = fmt.Sprintf("runtime %s does not exist", game.Spec.RuntimeRef.Name)
+	case jsdos.NamespaceReady(game.Namespace):
+		return jsdos, true, nil
+	}
+
+	patch := client.MergeFrom(game.DeepCopy())
+	meta.SetStatusCondition(&game.Status.Conditions, assetsReady)
+
+	if err := r.Status().Patch(ctx, game, patch); err != nil {
+		logger.V(5).Error(err, "unable to patch game status")
+		return nil, false, err
+	}
+
+	logger.Info(fmt.Sprintf("%s is not rolled out: %s", strings.ToLower(game.Name), assetsReady.Message))
+
+	return nil, false, nil
+}
+
+// runtimeVersion is the js-dos version the game runs on
+func (r *GameReconciler) runtimeVersion(game *operatorv1beta1.Game, jsdos *operatorv1beta1.JsDosRuntime) string {
+	if jsdos != nil {
+		return jsdos.Spec.Version
+	}
+
+	if game.Spec.Runtime.Version != "" {
+		return game.Spec.Runtime.Version
+	}
+
+	return r.RuntimeVersion
+}
+
+// gamesForRuntime maps a JsDosRuntime to the games referencing it, so they
+// are rolled out once it populated their namespace
+func (r *GameReconciler) gamesForRuntime(object client.Object) []reconcile.Request {
+	games := &operatorv1beta1.GameList{}
+	if err := r.List(context.Background(), games); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, game := range games.Items {
+		if game.Spec.RuntimeRef != nil && game.Spec.RuntimeRef.Name == object.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&game)})
+		}
+	}
+
+	return requests
+}
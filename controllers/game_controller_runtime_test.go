@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeploymentRuntimeVersion(t *testing.T) {
+	r := &GameReconciler{
+		RuntimeVersion: "7.4.7",
+		RuntimeUrl:     "https://cdn.jsdelivr.net/npm/js-dos@{version}/dist",
+	}
+
+	// versions the crd accepts may look like numbers or booleans to yaml
+	for _, version := range []string{"8", "6.22", "1e3", "true", "7.4.7"} {
+		game := &operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+			Spec: operatorv1beta1.GameSpec{
+				Deploy:   true,
+				Bundle:   operatorv1beta1.BundleSpec{Url: "https://cdn.dos.zone/original/2X/doom.jsdos"},
+				Exposure: operatorv1beta1.ExposureSpec{Port: 80, Path: "/"},
+				Runtime:  operatorv1beta1.RuntimeSpec{Version: version},
+			},
+		}
+
+		parameters, err := r.deploymentParameters(game, nil, false)
+		if err != nil {
+			t.Fatalf("building deployment parameters for %s: %v", version, err)
+		}
+
+		deployment, err := assets.GetDeployment(parameters)
+		if err != nil {
+			t.Errorf("rendering deployment for %s: %v", version, err)
+			continue
+		}
+
+		if deployment.Spec.Template.Annotations[runtimeVersionAnnotation] != version {
+			t.Errorf("deployment for %s is annotated with %q", version, deployment.Spec.Template.Annotations[runtimeVersionAnnotation])
+		}
+
+		if mount := deployment.Spec.Template.Spec.Containers[0].VolumeMounts[0]; mount.SubPath != version {
+			t.Errorf("assets of %s are mounted from %q", version, mount.SubPath)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/heistp/antler/node/metric"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	// defaultStorageHeadroom is the headroom added on top of a bundle, in
+	// percent of its size
+	defaultStorageHeadroom = 10
+
+	// defaultStorageReserve is added on top of a bundle and its headroom, for
+	// the files served next to it
+	defaultStorageReserve = 10 * 1024 * 1024
+	// defaultStorageSaves is how much the saves of a game or a session may
+	// take
+	defaultStorageSaves = 256 * 1024 * 1024
+)
+
+// StorageSizer works out the storage request of the claim of a game from the
+// size of its bundle
+type StorageSizer struct {
+	// Headroom is added on top of the bundle, in percent of its size
+	Headroom int
+	// Reserve is added on top of the bundle and its headroom, in bytes
+	Reserve int64
+	// Saves is how much the saves of a game or a session may take, in bytes.
+	// The save service refuses saves beyond it, and the claim of a session
+	// keeps room for them.
+	Saves int64
+}
+
+// DefaultStorageSizer is the sizer of games unless the manager is told otherwise
+var DefaultStorageSizer = StorageSizer{
+	Headroom: defaultStorageHeadroom,
+	Reserve:  defaultStorageReserve,
+	Saves:    defaultStorageSaves,
+}
+
+// Mebibytes returns the storage needed by a bundle of the given length in
+// MiB, rounded up. A length of zero stands for a bundle of unknown size.
+func (s StorageSizer) Mebibytes(length int64) uint64 {
+	if length <= 0 {
+		length = defaultBundleLength
+	}
+
+	storage := metric.Bytes(length + length*int64(s.Headroom)/100 + s.Reserve)
+
+	return uint64(math.Ceil(storage.Mebibytes()))
+}
+
+// SavesMebibytes returns the room kept for the saves of the player of a
+// session in MiB, rounded up
+func (s StorageSizer) SavesMebibytes() uint64 {
+	return uint64(math.Ceil(metric.Bytes(s.Saves).Mebibytes()))
+}
+
+// StorageSize is the storage request of the claim of a game
+type StorageSize struct {
+	// Mebibytes is the size of the claim in MiB
+	Mebibytes uint64
+	// BundleLength is the size of the bundle the claim was sized for, zero if
+	// it is unknown or the size was set explicitly
+	BundleLength int64
+}
+
+// SizeStorage works out the size of the claim of a game: spec.persistence.size
+// if set, otherwise the size of its bundle plus headroom. The outcome is
+// recorded in the StorageReady condition, so a bundle whose size cannot be
+// probed shows up on the game instead of only in the logs of the manager.
+func (r *GameReconciler) SizeStorage(
+	ctx context.Context,
+	req ctrl.Request,
+	game *operatorv1beta1.Game,
+) (*StorageSize, error) {
+	condition := metav1.Condition{
+		Type:               operatorv1beta1.ConditionStorageReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: game.Generation,
+		Reason:             "Sized",
+	}
+
+	size := &StorageSize{}
+
+	switch explicit := game.Spec.Persistence.Size; {
+	case explicit != nil && !explicit.IsZero():
+		size.Mebibytes = uint64(math.Ceil(metric.Bytes(explicit.Value()).Mebibytes()))
+		condition.Message = fmt.Sprintf("storage is set to %dMi", size.Mebibytes)
+	default:
+		length, err := r.bundleLength(ctx, game)
+		if err != nil {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "SizingFailed"
+			condition.Message = err.Error()
+
+			if patchErr := r.setStorageCondition(ctx, game, condition); patchErr != nil {
+				return nil, patchErr
+			}
+
+			logger.Error(err, fmt.Sprintf("unable to size the storage of %s", strings.ToLower(game.Name)))
+			return nil, err
+		}
+
+		size.BundleLength = length
+		size.Mebibytes = r.Sizer.Mebibytes(length)
+
+		condition.Message = fmt.Sprintf("storage is sized to %dMi for a bundle of unknown size", size.Mebibytes)
+		if length > 0 {
+			condition.Message = fmt.Sprintf("storage is sized to %dMi for a bundle of %d bytes", size.Mebibytes, length)
+		}
+	}
+
+	return size, r.setStorageCondition(ctx, game, condition)
+}
+
+func (r *GameReconciler) setStorageCondition(
+	ctx context.Context,
+	game *operatorv1beta1.Game,
+	condition metav1.Condition,
+) error {
+	patch := client.MergeFrom(game.DeepCopy())
+	meta.SetStatusCondition(&game.Status.Conditions, condition)
+
+	err := r.Status().Patch(ctx, game, patch)
+	if err != nil {
+		logger.V(5).Error(err, "unable to patch game status")
+		return err
+	}
+
+	return nil
+}
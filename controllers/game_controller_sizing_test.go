@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestStorageSizer(t *testing.T) {
+	sizer := StorageSizer{Headroom: 10, Reserve: 10 * 1024 * 1024}
+
+	for _, tc := range []struct {
+		length int64
+		want   uint64
+	}{
+		{length: 0, want: 32},                  // 20MiB default + 2MiB + 10MiB
+		{length: 100 * 1024 * 1024, want: 120}, // 100MiB + 10MiB + 10MiB
+		{length: 1, want: 11},                  // rounded up
+	} {
+		if got := sizer.Mebibytes(tc.length); got != tc.want {
+			t.Errorf("a bundle of %d bytes needs %dMi, expected %dMi", tc.length, got, tc.want)
+		}
+	}
+}
+
+func TestSizeStorage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/broken.jsdos":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodHead:
+			// some cdns refuse HEAD requests
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Header.Get("Range") == "bytes=0-0":
+			w.Header().Set("Content-Range", "bytes 0-0/52428800")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("P"))
+		default:
+			t.Errorf("unexpected %s request without a range", r.Method)
+		}
+	}))
+	defer server.Close()
+
+	size := resource.MustParse("1Gi")
+	games := []*operatorv1beta1.Game{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "default"},
+			Spec: operatorv1beta1.GameSpec{
+				Bundle: operatorv1beta1.BundleSpec{Url: server.URL + "/packman.jsdos"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "default"},
+			Spec: operatorv1beta1.GameSpec{
+				Bundle:      operatorv1beta1.BundleSpec{Url: server.URL + "/broken.jsdos"},
+				Persistence: operatorv1beta1.PersistenceSpec{Size: &size},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "default"},
+			Spec: operatorv1beta1.GameSpec{
+				Bundle: operatorv1beta1.BundleSpec{Url: server.URL + "/broken.jsdos"},
+			},
+		},
+	}
+
+	r := newFakeReconciler(games[0], games[1], games[2])
+	r.Sizer = DefaultStorageSizer
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		game   *operatorv1beta1.Game
+		want   uint64
+		length int64
+		failed bool
+	}{
+		{game: games[0], want: 65, length: 50 * 1024 * 1024},
+		{game: games[1], want: 1024},
+		{game: games[2], failed: true},
+	} {
+		req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tc.game)}
+		storage, err := r.SizeStorage(ctx, req, tc.game)
+
+		condition := meta.FindStatusCondition(tc.game.Status.Conditions, operatorv1beta1.ConditionStorageReady)
+		if condition == nil || (condition.Status == metav1.ConditionFalse) != tc.failed {
+			t.Errorf("%s storage condition is %+v", tc.game.Name, condition)
+		}
+
+		if tc.failed {
+			if err == nil {
+				t.Errorf("%s storage is sized despite its bundle missing", tc.game.Name)
+			}
+			continue
+		}
+
+		if err != nil || storage.Mebibytes != tc.want || storage.BundleLength != tc.length {
+			t.Errorf("%s storage is %+v (%v), expected %dMi for %d bytes", tc.game.Name, storage, err, tc.want, tc.length)
+		}
+	}
+}
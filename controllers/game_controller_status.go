@@ -3,19 +3,89 @@ package controllers
 import (
 	"context"
 	"fmt"
-	operatorv1alpha1 "github.com/akyriako/kube-dosbox/api/v1alpha1"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
 	"strings"
-	"time"
 )
 
+const (
+	bundleSizeAnnotation = "dosbox.contrib/bundle-size"
+	// runtimeVersionAnnotation is stamped on the pod template of a game with
+	// the js-dos version it runs on
+	runtimeVersionAnnotation = "dosbox.contrib/js-dos-version"
+)
+
+var (
+	// failingContainerReasons are the waiting reasons of a container that
+	// will not recover without an intervention
+	failingContainerReasons = map[string]bool{
+		"CrashLoopBackOff":           true,
+		"ErrImagePull":               true,
+		"ImagePullBackOff":           true,
+		"CreateContainerConfigError": true,
+		"RunContainerError":          true,
+	}
+)
+
+// GameObservation is what the controller observed about the resources of a Game
+type GameObservation struct {
+	Scheduled      bool
+	BundleFetched  bool
+	AssetsReady    bool
+	Ready          bool
+	Degraded       bool
+	Reason         string
+	Message        string
+	Endpoint       string
+	URL            string
+	BundleSize     *resource.Quantity
+	RuntimeVersion string
+	// BundleMismatch is why the pod refused the bundle of the game, when it
+	// no longer matches the digest it was verified with
+	BundleMismatch string
+	// Address is the ip of the ready pod of the game
+	Address string
+	// Idle is set for a game scaled to zero for lack of traffic, IdleReason
+	// for any game with spec.idle
+	Idle       bool
+	IdleReason string
+	// Suspended is set for a game scaled to zero by spec.suspend
+	Suspended bool
+	// Sessions are the GameSessions running an instance of the game
+	Sessions []operatorv1beta1.GameSessionReference
+}
+
+func (o *GameObservation) Phase() operatorv1beta1.GamePhase {
+	switch {
+	case o.Suspended:
+		return operatorv1beta1.GamePhaseSuspended
+	case o.Ready:
+		return operatorv1beta1.GamePhaseRunning
+	case o.Degraded:
+		return operatorv1beta1.GamePhaseDegraded
+	case o.Idle:
+		return operatorv1beta1.GamePhaseIdle
+	case !o.Scheduled:
+		return operatorv1beta1.GamePhasePending
+	case !o.BundleFetched || !o.AssetsReady:
+		return operatorv1beta1.GamePhaseDownloading
+	default:
+		return operatorv1beta1.GamePhaseStarting
+	}
+}
+
 func (r *GameReconciler) GetStatus(
 	ctx context.Context,
 	req ctrl.Request,
 	appLabel string,
-) (bool, error) {
+) (*GameObservation, error) {
 	pods := &corev1.PodList{}
 	opts := []client.ListOption{
 		client.MatchingLabels(map[string]string{"app": appLabel}),
@@ -23,38 +93,127 @@ func (r *GameReconciler) GetStatus(
 	}
 
 	if err := r.List(ctx, pods, opts...); err != nil {
-		return false, err
+		return nil, err
 	}
 
-	ready := false
+	observation := &GameObservation{
+		Reason:  "PodPending",
+		Message: "no pod has been scheduled yet",
+	}
 	for _, pod := range pods.Items {
-		if len(pod.Status.InitContainerStatuses) > 0 && len(pod.Status.ContainerStatuses) > 0 {
-			init := pod.Status.InitContainerStatuses[0].Ready && pod.Status.InitContainerStatuses[1].Ready
-			engine := pod.Status.ContainerStatuses[0]
-
-			ready = init && engine.Ready
+		if pod.DeletionTimestamp != nil {
+			continue
 		}
 
-		if ready {
+		observation = observePod(&pod, appLabel)
+		if observation.Ready {
 			break
 		}
 	}
 
-	return ready, nil
+	return observation, nil
 }
 
+func observePod(pod *corev1.Pod, appLabel string) *GameObservation {
+	observation := &GameObservation{
+		Scheduled: true,
+		Reason:    "PodInitializing",
+		Message:   fmt.Sprintf("pod %s is %s", pod.Name, strings.ToLower(string(pod.Status.Phase))),
+	}
+
+	// pods of games running on a JsDosRuntime find their assets in place
+	observation.AssetsReady = true
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == fmt.Sprintf("%s-init-assets", appLabel) {
+			observation.AssetsReady = false
+		}
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		completed := status.Ready ||
+			(status.State.Terminated != nil && status.State.Terminated.ExitCode == 0)
+
+		switch status.Name {
+		case fmt.Sprintf("%s-init-bundle", appLabel):
+			observation.BundleFetched = completed
+			observation.BundleMismatch = bundleMismatch(status)
+		case fmt.Sprintf("%s-init-assets", appLabel):
+			observation.AssetsReady = completed
+		}
+
+		if reason, failed := containerFailure(status); failed {
+			observation.Degraded = true
+			observation.Reason = reason
+			observation.Message = fmt.Sprintf("init container %s is failing: %s", status.Name, reason)
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != fmt.Sprintf("%s-engine", appLabel) {
+			continue
+		}
+
+		observation.Ready = status.Ready && observation.BundleFetched && observation.AssetsReady
+		if observation.Ready {
+			observation.Reason = "PodReady"
+			observation.Message = fmt.Sprintf("pod %s is ready", pod.Name)
+			observation.Address = pod.Status.PodIP
+		}
+
+		if reason, failed := containerFailure(status); failed {
+			observation.Degraded = true
+			observation.Reason = reason
+			observation.Message = fmt.Sprintf("container %s is failing: %s", status.Name, reason)
+		}
+	}
+
+	return observation
+}
+
+// bundleMismatch returns the termination message of an init container that
+// found the bundle not matching its digest, if it did
+func bundleMismatch(status corev1.ContainerStatus) string {
+	for _, terminated := range []*corev1.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+		if terminated != nil && terminated.ExitCode != 0 && strings.HasPrefix(terminated.Message, "bundle sha256 is") {
+			return strings.TrimSpace(terminated.Message)
+		}
+	}
+
+	return ""
+}
+
+func containerFailure(status corev1.ContainerStatus) (string, bool) {
+	if status.State.Waiting != nil && failingContainerReasons[status.State.Waiting.Reason] {
+		return status.State.Waiting.Reason, true
+	}
+
+	if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+		if status.State.Terminated.Reason == "" {
+			return "ContainerFailed", true
+		}
+
+		return status.State.Terminated.Reason, true
+	}
+
+	return "", false
+}
+
+// SetStatus patches the status of the game with the given observation. A nil
+// observation means the game is not deployed.
 func (r *GameReconciler) SetStatus(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
-	ready bool,
+	game *operatorv1beta1.Game,
+	observation *GameObservation,
 ) error {
 	patch := client.MergeFrom(game.DeepCopy())
-	if ready == true {
-		game.Status.Ready = &ready
+
+	if observation == nil {
+		setUndeployedStatus(game)
 	} else {
-		game.Status.Ready = nil
+		setObservedStatus(game, observation)
 	}
+	game.Status.ObservedGeneration = game.Generation
 
 	err := r.Status().Patch(ctx, game, patch)
 	if err != nil {
@@ -62,49 +221,214 @@ func (r *GameReconciler) SetStatus(
 		return err
 	}
 
-	if ready {
+	if observation != nil && observation.Ready {
 		logger.Info(fmt.Sprintf("%s is ready", strings.ToLower(game.Name)))
 	}
 
 	return nil
 }
 
+func setUndeployedStatus(game *operatorv1beta1.Game) {
+	ready := false
+	game.Status.Ready = &ready
+	game.Status.Phase = operatorv1beta1.GamePhaseUndeployed
+	game.Status.Endpoint = ""
+	game.Status.URL = ""
+	game.Status.Sessions = nil
+	meta.RemoveStatusCondition(&game.Status.Conditions, operatorv1beta1.ConditionIdle)
+	meta.RemoveStatusCondition(&game.Status.Conditions, operatorv1beta1.ConditionSuspended)
+
+	for _, conditionType := range []string{
+		operatorv1beta1.ConditionBundleFetched,
+		operatorv1beta1.ConditionAssetsReady,
+		operatorv1beta1.ConditionAvailable,
+		operatorv1beta1.ConditionDegraded,
+	} {
+		meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+			Type:               conditionType,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: game.Generation,
+			Reason:             "DeployDisabled",
+			Message:            "spec.deploy is false",
+		})
+	}
+}
+
+func setObservedStatus(game *operatorv1beta1.Game, observation *GameObservation) {
+	ready := observation.Ready
+	game.Status.Ready = &ready
+	game.Status.Phase = observation.Phase()
+	game.Status.Endpoint = observation.Endpoint
+	game.Status.URL = observation.URL
+	game.Status.RuntimeVersion = observation.RuntimeVersion
+	game.Status.Sessions = observation.Sessions
+	if observation.BundleSize != nil {
+		game.Status.BundleSize = observation.BundleSize
+	}
+
+	meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+		Type:               operatorv1beta1.ConditionBundleFetched,
+		Status:             conditionStatus(observation.BundleFetched),
+		ObservedGeneration: game.Generation,
+		Reason:             conditionText(observation.BundleFetched, "Downloaded", "Downloading"),
+		Message:            conditionText(observation.BundleFetched, "bundle downloaded", observation.Message),
+	})
+
+	meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+		Type:               operatorv1beta1.ConditionAssetsReady,
+		Status:             conditionStatus(observation.AssetsReady),
+		ObservedGeneration: game.Generation,
+		Reason:             conditionText(observation.AssetsReady, "Downloaded", "Downloading"),
+		Message:            conditionText(observation.AssetsReady, "emulator assets downloaded", observation.Message),
+	})
+
+	meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+		Type:               operatorv1beta1.ConditionAvailable,
+		Status:             conditionStatus(observation.Ready),
+		ObservedGeneration: game.Generation,
+		Reason:             observation.Reason,
+		Message:            observation.Message,
+	})
+
+	meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+		Type:               operatorv1beta1.ConditionDegraded,
+		Status:             conditionStatus(observation.Degraded),
+		ObservedGeneration: game.Generation,
+		Reason:             conditionText(observation.Degraded, observation.Reason, "AsExpected"),
+		Message:            conditionText(observation.Degraded, observation.Message, ""),
+	})
+
+	// a bundle changing at its source after it was verified is refused by
+	// the pod as well
+	if observation.BundleMismatch != "" {
+		meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+			Type:               operatorv1beta1.ConditionBundleVerified,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: game.Generation,
+			Reason:             "DigestMismatch",
+			Message:            observation.BundleMismatch,
+		})
+	}
+
+	// a game that was never suspended does not report the condition
+	if observation.Suspended || meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionSuspended) != nil {
+		meta.SetStatusCondition(&game.Status.Conditions, metav1.Condition{
+			Type:               operatorv1beta1.ConditionSuspended,
+			Status:             conditionStatus(observation.Suspended),
+			ObservedGeneration: game.Generation,
+			Reason:             conditionText(observation.Suspended, "Suspended", "Resumed"),
+			Message:            conditionText(observation.Suspended, "spec.suspend is true, the game is scaled to zero", "the game resumed"),
+		})
+	}
+
+	if game.Spec.Idle == nil {
+		meta.RemoveStatusCondition(&game.Status.Conditions, operatorv1beta1.ConditionIdle)
+		return
+	}
+
+	idle := metav1.Condition{
+		Type:               operatorv1beta1.ConditionIdle,
+		Status:             conditionStatus(observation.Idle),
+		ObservedGeneration: game.Generation,
+		Reason:             observation.IdleReason,
+		Message:            fmt.Sprintf("scaled to zero after %d minutes without requests", game.Spec.Idle.Minutes),
+	}
+
+	switch observation.IdleReason {
+	case "NoTraffic":
+		idle.Message = fmt.Sprintf("no request for %d minutes, scaled to zero", game.Spec.Idle.Minutes)
+	case "ActivatorDisabled":
+		idle.Message = "the manager runs without an activator, the game is never scaled to zero"
+	}
+
+	meta.SetStatusCondition(&game.Status.Conditions, idle)
+}
+
+func conditionStatus(value bool) metav1.ConditionStatus {
+	if value {
+		return metav1.ConditionTrue
+	}
+
+	return metav1.ConditionFalse
+}
+
+func conditionText(value bool, whenTrue string, whenFalse string) string {
+	if value {
+		return whenTrue
+	}
+
+	return whenFalse
+}
+
+// RefreshStatus updates the status of the game from its pods. There is no need
+// to poll, as the controller watches the pods and the dependents of every game.
 func (r *GameReconciler) RefreshStatus(
 	ctx context.Context,
 	req ctrl.Request,
-	game *operatorv1alpha1.Game,
-	appLabel string,
+	game *operatorv1beta1.Game,
+	deployment *appsv1.Deployment,
+	svc *corev1.Service,
+	pvc *corev1.PersistentVolumeClaim,
+	url string,
+	idle bool,
 ) (ctrl.Result, error) {
-	ready, err := r.GetStatus(ctx, req, appLabel)
+	observation, err := r.GetStatus(ctx, req, deployment.Labels["app"])
 	if err != nil {
 		logger.V(5).Error(err, "unable to fetch pod status")
+		return ctrl.Result{}, err
+	}
 
-		_ = r.SetStatus(ctx, req, game, false)
+	observation.Endpoint = serviceEndpoint(svc)
+	observation.URL = url
+	observation.BundleSize = bundleSize(pvc)
+	observation.RuntimeVersion = deployment.Spec.Template.Annotations[runtimeVersionAnnotation]
+	observation.Idle = idle && !observation.Ready
+	observation.Suspended = game.Spec.Suspend
+	if game.Spec.Idle != nil {
+		observation.IdleReason = r.idleReason(observation.Idle)
+	}
 
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: 15 * time.Second,
-		}, err
+	sessions, err := listSessions(ctx, r.Client, game.Namespace, game.Name)
+	if err != nil {
+		logger.V(5).Error(err, "unable to list sessions")
+		return ctrl.Result{}, err
 	}
 
-	if !ready {
-		logger.Info("pod not ready, requeue in 15sec")
+	for _, session := range sessions {
+		observation.Sessions = append(observation.Sessions, operatorv1beta1.GameSessionReference{
+			Name:      session.Name,
+			Player:    session.Spec.Player,
+			Phase:     session.Status.Phase,
+			URL:       session.Status.URL,
+			ExpiresAt: session.Status.ExpiresAt,
+		})
+	}
+
+	err = r.SetStatus(ctx, req, game, observation)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
-		_ = r.SetStatus(ctx, req, game, ready)
+	return ctrl.Result{}, nil
+}
 
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: 15 * time.Second,
-		}, nil
+func serviceEndpoint(svc *corev1.Service) string {
+	if svc == nil || len(svc.Spec.Ports) == 0 {
+		return ""
 	}
 
-	err = r.SetStatus(ctx, req, game, ready)
+	return fmt.Sprintf("http://%s.%s.svc:%d", svc.Name, svc.Namespace, svc.Spec.Ports[0].Port)
+}
+
+func bundleSize(pvc *corev1.PersistentVolumeClaim) *resource.Quantity {
+	if pvc == nil {
+		return nil
+	}
+
+	size, err := strconv.ParseInt(pvc.Annotations[bundleSizeAnnotation], 10, 64)
 	if err != nil {
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: 15 * time.Second,
-		}, nil
+		return nil
 	}
 
-	return ctrl.Result{}, nil
+	return resource.NewQuantity(size, resource.BinarySI)
 }
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGamePhase(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		observation GameObservation
+		want        operatorv1beta1.GamePhase
+	}{
+		{
+			name:        "no pod scheduled",
+			observation: GameObservation{},
+			want:        operatorv1beta1.GamePhasePending,
+		},
+		{
+			name:        "bundle downloading",
+			observation: GameObservation{Scheduled: true, AssetsReady: true},
+			want:        operatorv1beta1.GamePhaseDownloading,
+		},
+		{
+			name:        "assets downloading",
+			observation: GameObservation{Scheduled: true, BundleFetched: true},
+			want:        operatorv1beta1.GamePhaseDownloading,
+		},
+		{
+			name:        "engine starting",
+			observation: GameObservation{Scheduled: true, BundleFetched: true, AssetsReady: true},
+			want:        operatorv1beta1.GamePhaseStarting,
+		},
+		{
+			name:        "ready",
+			observation: GameObservation{Scheduled: true, BundleFetched: true, AssetsReady: true, Ready: true},
+			want:        operatorv1beta1.GamePhaseRunning,
+		},
+		{
+			name:        "failing",
+			observation: GameObservation{Scheduled: true, Degraded: true},
+			want:        operatorv1beta1.GamePhaseDegraded,
+		},
+		{
+			name:        "ready while a container restarts",
+			observation: GameObservation{Scheduled: true, BundleFetched: true, AssetsReady: true, Ready: true, Degraded: true},
+			want:        operatorv1beta1.GamePhaseRunning,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if phase := tc.observation.Phase(); phase != tc.want {
+				t.Errorf("phase is %s, expected %s", phase, tc.want)
+			}
+		})
+	}
+}
+
+func TestObservedStatus(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade", Generation: 3},
+		Spec:       operatorv1beta1.GameSpec{Deploy: true},
+	}
+
+	setObservedStatus(game, &GameObservation{
+		Scheduled: true,
+		Degraded:  true,
+		Reason:    "CrashLoopBackOff",
+		Message:   "container doom-engine is failing: CrashLoopBackOff",
+		Endpoint:  "http://doom.arcade.svc:80",
+	})
+
+	if *game.Status.Ready || game.Status.Phase != operatorv1beta1.GamePhaseDegraded || game.Status.Endpoint != "http://doom.arcade.svc:80" {
+		t.Errorf("failing game is ready %v in phase %s at %q", *game.Status.Ready, game.Status.Phase, game.Status.Endpoint)
+	}
+
+	for conditionType, want := range map[string]metav1.ConditionStatus{
+		operatorv1beta1.ConditionBundleFetched: metav1.ConditionFalse,
+		operatorv1beta1.ConditionAssetsReady:   metav1.ConditionFalse,
+		operatorv1beta1.ConditionAvailable:     metav1.ConditionFalse,
+		operatorv1beta1.ConditionDegraded:      metav1.ConditionTrue,
+	} {
+		condition := meta.FindStatusCondition(game.Status.Conditions, conditionType)
+		if condition == nil || condition.Status != want || condition.ObservedGeneration != game.Generation {
+			t.Errorf("condition %s is %+v, expected %s at generation %d", conditionType, condition, want, game.Generation)
+		}
+	}
+
+	if degraded := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionDegraded); degraded.Reason != "CrashLoopBackOff" {
+		t.Errorf("Degraded condition has reason %s, expected CrashLoopBackOff", degraded.Reason)
+	}
+
+	setObservedStatus(game, &GameObservation{Scheduled: true, BundleFetched: true, AssetsReady: true, Ready: true, Reason: "PodReady"})
+	if !*game.Status.Ready || game.Status.Phase != operatorv1beta1.GamePhaseRunning ||
+		!meta.IsStatusConditionTrue(game.Status.Conditions, operatorv1beta1.ConditionAvailable) ||
+		!meta.IsStatusConditionFalse(game.Status.Conditions, operatorv1beta1.ConditionDegraded) {
+		t.Errorf("ready game is %s with conditions %+v", game.Status.Phase, game.Status.Conditions)
+	}
+
+	setUndeployedStatus(game)
+	if *game.Status.Ready || game.Status.Phase != operatorv1beta1.GamePhaseUndeployed ||
+		meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionAvailable).Reason != "DeployDisabled" {
+		t.Errorf("undeployed game is %s with conditions %+v", game.Status.Phase, game.Status.Conditions)
+	}
+}
+
+func TestSuspendedStatus(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec:       operatorv1beta1.GameSpec{Deploy: true},
+	}
+
+	setObservedStatus(game, &GameObservation{Scheduled: true, BundleFetched: true, AssetsReady: true, Ready: true})
+	if meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionSuspended) != nil {
+		t.Errorf("a game never suspended reports the Suspended condition")
+	}
+
+	// the pod of the game may still be terminating
+	setObservedStatus(game, &GameObservation{Scheduled: true, Ready: true, Suspended: true})
+	if game.Status.Phase != operatorv1beta1.GamePhaseSuspended ||
+		!meta.IsStatusConditionTrue(game.Status.Conditions, operatorv1beta1.ConditionSuspended) {
+		t.Errorf("suspended game is %s with conditions %+v", game.Status.Phase, game.Status.Conditions)
+	}
+
+	setObservedStatus(game, &GameObservation{Scheduled: true})
+	condition := meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionSuspended)
+	if game.Status.Phase == operatorv1beta1.GamePhaseSuspended || condition == nil || condition.Reason != "Resumed" {
+		t.Errorf("resumed game is %s with Suspended condition %+v", game.Status.Phase, condition)
+	}
+
+	setUndeployedStatus(game)
+	if meta.FindStatusCondition(game.Status.Conditions, operatorv1beta1.ConditionSuspended) != nil {
+		t.Errorf("an undeployed game reports the Suspended condition")
+	}
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Game webhook", func() {
+	newGame := func(name string, gameName string, deploy bool) *operatorv1beta1.Game {
+		return &operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: operatorv1beta1.GameSpec{
+				GameName: gameName,
+				Deploy:   deploy,
+				Bundle: operatorv1beta1.BundleSpec{
+					Url: "https://cdn.dos.zone/custom/dos/packman.jsdos",
+				},
+			},
+		}
+	}
+
+	AfterEach(func() {
+		Expect(k8sClient.DeleteAllOf(ctx, &operatorv1beta1.Game{}, client.InNamespace("default"))).To(Succeed())
+	})
+
+	It("defaults the optional fields", func() {
+		game := newGame("packman", "Packman", false)
+		Expect(k8sClient.Create(ctx, game)).To(Succeed())
+
+		Expect(game.Spec.Exposure.Port).To(Equal(80))
+		Expect(game.Spec.Persistence.RetentionPolicy).To(Equal(operatorv1beta1.RetentionPolicyDelete))
+	})
+
+	It("labels games with their metadata", func() {
+		game := newGame("doom", "Doom", false)
+		game.Spec.Publisher = "id Software"
+		game.Spec.Year = 1993
+		game.Spec.Genre = "First-person shooter"
+		game.Spec.Tags = []string{"Shareware", "multi player"}
+		Expect(k8sClient.Create(ctx, game)).To(Succeed())
+
+		Expect(game.Labels).To(Equal(map[string]string{
+			operatorv1beta1.PublisherLabel:                  "id-software",
+			operatorv1beta1.YearLabel:                       "1993",
+			operatorv1beta1.GenreLabel:                      "first-person-shooter",
+			operatorv1beta1.TagLabelPrefix + "shareware":    "true",
+			operatorv1beta1.TagLabelPrefix + "multi-player": "true",
+		}))
+
+		game.Spec.Genre = ""
+		game.Spec.Tags = nil
+		Expect(k8sClient.Update(ctx, game)).To(Succeed())
+
+		Expect(game.Labels).NotTo(HaveKey(operatorv1beta1.GenreLabel))
+		Expect(game.Labels).NotTo(HaveKey(operatorv1beta1.TagLabelPrefix + "shareware"))
+	})
+
+	It("rejects invalid game names", func() {
+		for _, gameName := range []string{"   ", " Packman", "Pack\tman"} {
+			err := k8sClient.Create(ctx, newGame("packman", gameName, false))
+			Expect(apierrors.IsInvalid(err)).To(BeTrue(), "game name %q", gameName)
+		}
+	})
+
+	It("rejects bundles without exactly one source", func() {
+		game := newGame("packman", "Packman", false)
+		game.Spec.Bundle.Url = ""
+		err := k8sClient.Create(ctx, game)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+
+		game = newGame("packman", "Packman", false)
+		game.Spec.Bundle.Oci = "registry.local/games/packman:1.0"
+		err = k8sClient.Create(ctx, game)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	})
+
+	It("rejects bundle keys and paths that are not safe", func() {
+		for _, key := range []string{"packman\".jsdos", "games/packman.jsdos", "..packman.jsdos", "pack\nman.jsdos"} {
+			game := newGame("packman", "Packman", false)
+			game.Spec.Bundle.Url = ""
+			game.Spec.Bundle.ConfigMapRef = &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "bundles"},
+				Key:                  key,
+			}
+			err := k8sClient.Create(ctx, game)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue(), "configmap key %q", key)
+
+			game = newGame("packman", "Packman", false)
+			game.Spec.Bundle.Url = ""
+			game.Spec.Bundle.SecretRef = &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "bundles"},
+				Key:                  key,
+			}
+			err = k8sClient.Create(ctx, game)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue(), "secret key %q", key)
+		}
+
+		for _, path := range []string{"../etc/passwd", "games/../../packman.jsdos", "games//packman.jsdos", "games/", "games/pack\"man.jsdos", "games/$(id).jsdos", "games/pack\nman.jsdos"} {
+			game := newGame("packman", "Packman", false)
+			game.Spec.Bundle.Url = ""
+			game.Spec.Bundle.PersistentVolumeClaimRef = &operatorv1beta1.PersistentVolumeClaimBundleSource{Name: "bundles", Path: path}
+			err := k8sClient.Create(ctx, game)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue(), "claim path %q", path)
+		}
+
+		game := newGame("packman", "Packman", false)
+		game.Spec.Bundle.Url = ""
+		game.Spec.Bundle.PersistentVolumeClaimRef = &operatorv1beta1.PersistentVolumeClaimBundleSource{Name: "bundles", Path: "games/Pack Man 1983.jsdos"}
+		Expect(k8sClient.Create(ctx, game)).To(Succeed())
+	})
+
+	It("rejects games named after the instance of a session", func() {
+		session := &operatorv1beta1.GameSession{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+			Spec: operatorv1beta1.GameSessionSpec{
+				Player:  "alice",
+				GameRef: corev1.LocalObjectReference{Name: "packman"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, session)).To(Succeed())
+		defer func() {
+			Expect(k8sClient.Delete(ctx, session)).To(Succeed())
+		}()
+
+		// the webhook reads sessions from the cache of the manager
+		Eventually(func() bool {
+			game := newGame("packman-alice", "Packman", false)
+			err := k8sClient.Create(ctx, game)
+			if err == nil {
+				Expect(k8sClient.Delete(ctx, game)).To(Succeed())
+			}
+			return apierrors.IsInvalid(err)
+		}).Should(BeTrue())
+	})
+
+	It("rejects changing the game name", func() {
+		game := newGame("packman", "Packman", false)
+		Expect(k8sClient.Create(ctx, game)).To(Succeed())
+
+		game.Spec.GameName = "Pacman"
+		err := k8sClient.Update(ctx, game)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	})
+
+	It("rejects deployed games sharing a port", func() {
+		Expect(k8sClient.Create(ctx, newGame("packman", "Packman", true))).To(Succeed())
+		Expect(k8sClient.Create(ctx, newGame("prince", "Prince of Persia", false))).To(Succeed())
+
+		err := k8sClient.Create(ctx, newGame("doom", "Doom", true))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+
+		doom := newGame("doom", "Doom", true)
+		doom.Spec.Exposure.Port = 8080
+		Expect(k8sClient.Create(ctx, doom)).To(Succeed())
+	})
+
+	It("lets games routed to through an ingress share a port", func() {
+		for _, name := range []string{"keen", "wolf3d"} {
+			game := newGame(name, name, true)
+			game.Spec.Exposure.Type = operatorv1beta1.ExposureTypeIngress
+			game.Spec.Exposure.Host = "arcade.example.com"
+			game.Spec.Exposure.Path = "/" + name
+			Expect(k8sClient.Create(ctx, game)).To(Succeed())
+		}
+	})
+})
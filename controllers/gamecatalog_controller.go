@@ -0,0 +1,376 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// catalogLabel is stamped on the games materialized by a GameCatalog with
+	// its name
+	catalogLabel = "dosbox.contrib/catalog"
+	// defaultCatalogInterval is how often the index of a catalog is read,
+	// unless it sets spec.interval
+	defaultCatalogInterval = time.Hour
+)
+
+// catalogIndex is the document a GameCatalog reads, in JSON or YAML
+type catalogIndex struct {
+	Games []catalogEntry `json:"games"`
+}
+
+// catalogEntry is a game of the index of a catalog. Only these fields of the
+// game belong to the catalog, everything else, deploy included, is left to
+// whoever runs the game.
+type catalogEntry struct {
+	Name         string                        `json:"name"`
+	GameName     string                        `json:"gameName"`
+	Bundle       operatorv1beta1.BundleSpec    `json:"bundle"`
+	Description  string                        `json:"description,omitempty"`
+	Publisher    string                        `json:"publisher,omitempty"`
+	Year         int                           `json:"year,omitempty"`
+	Genre        string                        `json:"genre,omitempty"`
+	ThumbnailUrl string                        `json:"thumbnailUrl,omitempty"`
+	Controls     []operatorv1beta1.GameControl `json:"controls,omitempty"`
+	Tags         []string                      `json:"tags,omitempty"`
+}
+
+// apply copies the fields of the entry to the spec of a game
+func (e catalogEntry) apply(spec *operatorv1beta1.GameSpec) {
+	spec.GameName = e.GameName
+	spec.Bundle = e.Bundle
+	spec.Description = e.Description
+	spec.Publisher = e.Publisher
+	spec.Year = e.Year
+	spec.Genre = e.Genre
+	spec.ThumbnailUrl = e.ThumbnailUrl
+	spec.Controls = e.Controls
+	spec.Tags = e.Tags
+}
+
+// catalogSync is the outcome of syncing the games of a catalog with its index
+type catalogSync struct {
+	games     int
+	created   int
+	updated   int
+	pruned    int
+	conflicts []string
+	failed    []string
+}
+
+// GameCatalogReconciler reconciles a GameCatalog object
+type GameCatalogReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamecatalogs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamecatalogs/status,verbs=get;update;patch
+
+// Reconcile reads the index of the catalog and makes sure a game exists for
+// every entry of it, deleting the games no longer listed when the catalog
+// prunes. Games are created with deploy set to false and are never owned by
+// the catalog, so deleting the catalog leaves them be.
+func (r *GameCatalogReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithName("catalog")
+
+	catalog := &operatorv1beta1.GameCatalog{}
+	if err := r.Get(ctx, req.NamespacedName, catalog); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		log.V(5).Error(err, "unable to fetch catalog")
+		return ctrl.Result{}, err
+	}
+
+	if !catalog.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	interval := catalog.Spec.Interval.Duration
+	if interval <= 0 {
+		interval = defaultCatalogInterval
+	}
+
+	data, err := r.FetchIndex(ctx, catalog)
+	if err != nil {
+		log.Error(err, "unable to fetch catalog index")
+
+		reason := "FetchFailed"
+		if errors.Is(err, errInvalidSource) {
+			reason = "InvalidSource"
+		}
+
+		if err := r.SetStatus(ctx, catalog, "", nil, reason, err.Error()); err != nil {
+			log.V(5).Error(err, "unable to patch catalog status")
+			return ctrl.Result{}, err
+		}
+
+		if reason == "InvalidSource" {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	digest := sha256.Sum256(data)
+	revision := hex.EncodeToString(digest[:])
+
+	index := catalogIndex{}
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		log.Error(err, "unable to parse catalog index")
+
+		if err := r.SetStatus(ctx, catalog, revision, nil, "ParseFailed", err.Error()); err != nil {
+			log.V(5).Error(err, "unable to patch catalog status")
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+
+	sync, err := r.Sync(ctx, catalog, index)
+	if err != nil {
+		log.Error(err, "unable to sync catalog games")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.SetStatus(ctx, catalog, revision, sync, "", ""); err != nil {
+		log.V(5).Error(err, "unable to patch catalog status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// Sync creates a game for every entry of the index missing one and updates
+// the catalog fields of the games that differ from their entry, then prunes
+// the games of the catalog no longer listed, unless they are deployed. A game
+// of the same name not materialized by the catalog is left alone. Entries the
+// api server refuses are reported rather than failing the whole index.
+func (r *GameCatalogReconciler) Sync(
+	ctx context.Context,
+	catalog *operatorv1beta1.GameCatalog,
+	index catalogIndex,
+) (*catalogSync, error) {
+	sync := &catalogSync{}
+	listed := map[string]bool{}
+
+	for i, entry := range index.Games {
+		if errs := validation.IsDNS1123Subdomain(entry.Name); len(errs) > 0 {
+			sync.failed = append(sync.failed, fmt.Sprintf("entry %d: name %q %s", i, entry.Name, strings.Join(errs, ", ")))
+			continue
+		}
+
+		if listed[entry.Name] {
+			sync.failed = append(sync.failed, fmt.Sprintf("%s: listed more than once", entry.Name))
+			continue
+		}
+
+		listed[entry.Name] = true
+
+		game := &operatorv1beta1.Game{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: catalog.Namespace, Name: entry.Name}, game)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		if apierrors.IsNotFound(err) {
+			game = &operatorv1beta1.Game{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: catalog.Namespace,
+					Name:      entry.Name,
+					Labels:    map[string]string{catalogLabel: catalog.Name},
+				},
+			}
+			entry.apply(&game.Spec)
+
+			if err := r.Create(ctx, game); err != nil {
+				if !apierrors.IsInvalid(err) && !apierrors.IsForbidden(err) && !apierrors.IsBadRequest(err) {
+					return nil, err
+				}
+
+				sync.failed = append(sync.failed, fmt.Sprintf("%s: %s", entry.Name, err.Error()))
+				continue
+			}
+
+			sync.created++
+			sync.games++
+			continue
+		}
+
+		if game.Labels[catalogLabel] != catalog.Name {
+			sync.conflicts = append(sync.conflicts, entry.Name)
+			continue
+		}
+
+		sync.games++
+
+		patch := client.MergeFrom(game.DeepCopy())
+		spec := game.Spec.DeepCopy()
+		entry.apply(spec)
+
+		if equality.Semantic.DeepEqual(*spec, game.Spec) {
+			continue
+		}
+
+		game.Spec = *spec
+		if err := r.Patch(ctx, game, patch); err != nil {
+			if !apierrors.IsInvalid(err) && !apierrors.IsForbidden(err) && !apierrors.IsBadRequest(err) {
+				return nil, err
+			}
+
+			sync.failed = append(sync.failed, fmt.Sprintf("%s: %s", entry.Name, err.Error()))
+			continue
+		}
+
+		sync.updated++
+	}
+
+	if !catalog.Prunes() {
+		return sync, nil
+	}
+
+	games := &operatorv1beta1.GameList{}
+	if err := r.List(ctx, games, client.InNamespace(catalog.Namespace), client.MatchingLabels{catalogLabel: catalog.Name}); err != nil {
+		return nil, err
+	}
+
+	for i := range games.Items {
+		game := &games.Items[i]
+		if listed[game.Name] || game.Spec.Deploy || !game.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := r.Delete(ctx, game); err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		sync.pruned++
+	}
+
+	return sync, nil
+}
+
+// SetStatus records the outcome of the last sync of the catalog and sums it
+// up in the Synced condition. Without a sync, reason and message tell why
+// the index could not be read, and the games of the last sync are kept.
+func (r *GameCatalogReconciler) SetStatus(
+	ctx context.Context,
+	catalog *operatorv1beta1.GameCatalog,
+	revision string,
+	sync *catalogSync,
+	reason string,
+	message string,
+) error {
+	patch := client.MergeFrom(catalog.DeepCopy())
+
+	synced := metav1.Condition{
+		Type:               operatorv1beta1.ConditionCatalogSynced,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: catalog.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+
+	if sync != nil {
+		synced.Status = metav1.ConditionTrue
+		synced.Reason = "Synced"
+		synced.Message = fmt.Sprintf(
+			"%d games, %d created, %d updated, %d pruned",
+			sync.games, sync.created, sync.updated, sync.pruned,
+		)
+
+		switch {
+		case len(sync.failed) > 0:
+			synced.Status = metav1.ConditionFalse
+			synced.Reason = "InvalidEntries"
+			synced.Message = fmt.Sprintf("%s; %d entries refused: %s", synced.Message, len(sync.failed), strings.Join(sync.failed, "; "))
+		case len(sync.conflicts) > 0:
+			synced.Reason = "Conflicts"
+			synced.Message = fmt.Sprintf("%s; %d entries skipped, games of the same name exist", synced.Message, len(sync.conflicts))
+		}
+
+		sort.Strings(sync.conflicts)
+
+		catalog.Status.Games = sync.games
+		catalog.Status.Conflicts = sync.conflicts
+	}
+
+	if revision != "" {
+		catalog.Status.Revision = revision
+	}
+
+	now := metav1.Now()
+	catalog.Status.LastSyncTime = &now
+	catalog.Status.ObservedGeneration = catalog.Generation
+	meta.SetStatusCondition(&catalog.Status.Conditions, synced)
+
+	return r.Status().Patch(ctx, catalog, patch)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GameCatalogReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorv1beta1.GameCatalog{}).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.catalogsForConfigMap),
+		).
+		Complete(r)
+}
+
+// catalogsForConfigMap maps a configmap to the catalogs reading their index
+// from it
+func (r *GameCatalogReconciler) catalogsForConfigMap(object client.Object) []reconcile.Request {
+	catalogs := &operatorv1beta1.GameCatalogList{}
+	if err := r.List(context.Background(), catalogs, client.InNamespace(object.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, catalog := range catalogs.Items {
+		if ref := catalog.Spec.Source.ConfigMapRef; ref != nil && ref.Name == object.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&catalog)})
+		}
+	}
+
+	return requests
+}
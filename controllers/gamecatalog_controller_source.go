@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+const (
+	// catalogDownloadTimeout bounds how long the controller spends reading the
+	// index of a catalog
+	catalogDownloadTimeout = time.Minute
+
+	// maxCatalogLength is the largest index the controller reads
+	maxCatalogLength = 16 * 1024 * 1024
+)
+
+// ociManifestMediaTypes are the manifests an oci index may be pulled as
+var ociManifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// errInvalidSource is returned for a catalog not setting exactly one source
+var errInvalidSource = errors.New("exactly one of url, configMapRef or oci must be set")
+
+// FetchIndex reads the index of a catalog from its source
+func (r *GameCatalogReconciler) FetchIndex(ctx context.Context, catalog *operatorv1beta1.GameCatalog) ([]byte, error) {
+	source := catalog.Spec.Source
+
+	set := 0
+	for _, ok := range []bool{source.Url != "", source.ConfigMapRef != nil, source.Oci != ""} {
+		if ok {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return nil, errInvalidSource
+	}
+
+	if source.ConfigMapRef != nil {
+		cmap := &corev1.ConfigMap{}
+		objectKey := client.ObjectKey{Namespace: catalog.Namespace, Name: source.ConfigMapRef.Name}
+		if err := r.Get(ctx, objectKey, cmap); err != nil {
+			return nil, err
+		}
+
+		if data, ok := cmap.Data[source.ConfigMapRef.Key]; ok {
+			return []byte(data), nil
+		}
+
+		if data, ok := cmap.BinaryData[source.ConfigMapRef.Key]; ok {
+			return data, nil
+		}
+
+		return nil, fmt.Errorf("configmap %s has no key %s", cmap.Name, source.ConfigMapRef.Key)
+	}
+
+	secret := &corev1.Secret{}
+	if source.CredentialsSecretRef != nil {
+		objectKey := client.ObjectKey{Namespace: catalog.Namespace, Name: source.CredentialsSecretRef.Name}
+		if err := r.Get(ctx, objectKey, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, catalogDownloadTimeout)
+	defer cancel()
+
+	if source.Oci != "" {
+		return pullOciIndex(ctx, source.Oci, secret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", "application/json, application/yaml, text/yaml, */*")
+	setCredentials(request, secret)
+
+	return download(request)
+}
+
+// pullOciIndex pulls the first layer of an oci artifact, logging in to its
+// registry with the username and password of the secret, if any. Registries
+// on the local host are reached over plain http, every other one over https.
+func pullOciIndex(ctx context.Context, reference string, secret *corev1.Secret) ([]byte, error) {
+	registry, repository, tag, err := parseOciReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "https"
+	if host := strings.Split(registry, ":")[0]; host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+
+	puller := &ociPuller{secret: secret}
+	base := fmt.Sprintf("%s://%s/v2/%s", scheme, registry, repository)
+
+	data, err := puller.get(ctx, fmt.Sprintf("%s/manifests/%s", base, tag), strings.Join(ociManifestMediaTypes, ", "))
+	if err != nil {
+		return nil, fmt.Errorf("unable to pull manifest of %s: %w", reference, err)
+	}
+
+	manifest := struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest of %s: %w", reference, err)
+	}
+
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("%s has no layers", reference)
+	}
+
+	digest := manifest.Layers[0].Digest
+	data, err = puller.get(ctx, fmt.Sprintf("%s/blobs/%s", base, digest), "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to pull layer of %s: %w", reference, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return nil, fmt.Errorf("layer of %s has digest %s, expected %s", reference, actual, digest)
+	}
+
+	return data, nil
+}
+
+// parseOciReference splits a reference into its registry, its repository and
+// the tag or digest it points at, latest unless set
+func parseOciReference(reference string) (string, string, string, error) {
+	name, tag := reference, ""
+
+	if at := strings.Index(reference, "@"); at >= 0 {
+		name, tag = reference[:at], reference[at+1:]
+	}
+
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		if tag == "" {
+			tag = name[colon+1:]
+		}
+
+		name = name[:colon]
+	}
+
+	if tag == "" {
+		tag = "latest"
+	}
+
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok || registry == "" || repository == "" {
+		return "", "", "", fmt.Errorf("%s is not a valid oci reference", reference)
+	}
+
+	return registry, repository, tag, nil
+}
+
+// ociPuller reads from a registry, answering its challenge for credentials
+// once and reusing them for every later request
+type ociPuller struct {
+	secret        *corev1.Secret
+	authorization string
+}
+
+func (p *ociPuller) get(ctx context.Context, address string, accept string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+
+		if p.authorization != "" {
+			request.Header.Set("Authorization", p.authorization)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			defer response.Body.Close()
+
+			if response.StatusCode != http.StatusOK {
+				return nil, errors.New(response.Status)
+			}
+
+			return readAll(response.Body)
+		}
+
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+
+		if err := p.login(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// login answers the challenge of a registry, either with the credentials of
+// the secret for basic auth, or with a token issued for them
+func (p *ociPuller) login(ctx context.Context, challenge string) error {
+	username := credential(p.secret.Data[credentialsUsernameKey])
+	password := credential(p.secret.Data[credentialsPasswordKey])
+
+	scheme, parameters, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "basic") {
+		request := &http.Request{Header: http.Header{}}
+		request.SetBasicAuth(username, password)
+		p.authorization = request.Header.Get("Authorization")
+		return nil
+	}
+
+	if !strings.EqualFold(scheme, "bearer") {
+		return fmt.Errorf("unsupported registry challenge %q", challenge)
+	}
+
+	values := url.Values{}
+	var realm string
+	for _, parameter := range strings.Split(parameters, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "realm":
+			realm = value
+		case "service", "scope":
+			values.Set(key, value)
+		}
+	}
+
+	if realm == "" {
+		return fmt.Errorf("registry challenge %q has no realm", challenge)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	if username != "" {
+		request.SetBasicAuth(username, password)
+	}
+
+	data, err := download(request)
+	if err != nil {
+		return fmt.Errorf("unable to log in to registry: %w", err)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return fmt.Errorf("unable to log in to registry: %w", err)
+	}
+
+	p.authorization = fmt.Sprintf("Bearer %s", firstOf(token.Token, token.AccessToken))
+
+	return nil
+}
+
+// download reads the body of the response to a request
+func download(request *http.Request) ([]byte, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(response.Status)
+	}
+
+	return readAll(response.Body)
+}
+
+// readAll reads a body up to the largest index the controller reads
+func readAll(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxCatalogLength+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxCatalogLength {
+		return nil, fmt.Errorf("index is larger than %d bytes", maxCatalogLength)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const catalogIndexYaml = `
+games:
+- name: doom
+  gameName: Doom
+  publisher: id Software
+  bundle:
+    url: https://cdn.dos.zone/original/2X/doom.jsdos
+- name: keen
+  gameName: Commander Keen
+  bundle:
+    url: https://cdn.dos.zone/original/2X/keen.jsdos
+- name: prince
+  gameName: Prince of Persia
+  bundle:
+    url: https://cdn.dos.zone/original/2X/prince.jsdos
+`
+
+func TestGameCatalogSync(t *testing.T) {
+	cmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "dos", Namespace: "arcade"},
+		Data:       map[string]string{"index.yaml": catalogIndexYaml},
+	}
+
+	catalog := &operatorv1beta1.GameCatalog{
+		ObjectMeta: metav1.ObjectMeta{Name: "dos", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameCatalogSpec{
+			Source: operatorv1beta1.GameCatalogSource{
+				ConfigMapRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: cmap.Name},
+					Key:                  "index.yaml",
+				},
+			},
+		},
+	}
+
+	labels := map[string]string{catalogLabel: catalog.Name}
+	games := []client.Object{
+		// deployed by hand, the catalog only updates its bundle
+		&operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade", Labels: labels},
+			Spec: operatorv1beta1.GameSpec{
+				GameName: "Doom",
+				Deploy:   true,
+				Bundle:   operatorv1beta1.BundleSpec{Url: "https://cdn.dos.zone/original/2X/shareware.jsdos"},
+			},
+		},
+		// not materialized by the catalog
+		&operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "prince", Namespace: "arcade"},
+			Spec:       operatorv1beta1.GameSpec{GameName: "My Prince"},
+		},
+		// removed from the index
+		&operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "wolf3d", Namespace: "arcade", Labels: labels},
+			Spec:       operatorv1beta1.GameSpec{GameName: "Wolfenstein 3D"},
+		},
+		// removed from the index, but deployed
+		&operatorv1beta1.Game{
+			ObjectMeta: metav1.ObjectMeta{Name: "tyrian", Namespace: "arcade", Labels: labels},
+			Spec:       operatorv1beta1.GameSpec{GameName: "Tyrian", Deploy: true},
+		},
+	}
+
+	c := newFakeClient(append(games, cmap, catalog)...)
+	r := &GameCatalogReconciler{Client: c, Scheme: c.Scheme()}
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(catalog)}); err != nil {
+		t.Fatalf("reconciling catalog: %v", err)
+	}
+
+	game := &operatorv1beta1.Game{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "keen"}, game); err != nil {
+		t.Fatalf("keen is not materialized: %v", err)
+	}
+
+	if game.Spec.Deploy || game.Labels[catalogLabel] != catalog.Name {
+		t.Errorf("keen is materialized as %+v", game)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "doom"}, game); err != nil {
+		t.Fatalf("fetching doom: %v", err)
+	}
+
+	if !game.Spec.Deploy || game.Spec.Publisher != "id Software" || !strings.HasSuffix(game.Spec.Bundle.Url, "/doom.jsdos") {
+		t.Errorf("doom is updated to %+v", game.Spec)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "prince"}, game); err != nil || game.Spec.GameName != "My Prince" {
+		t.Errorf("prince is overwritten: %+v (%v)", game.Spec, err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "wolf3d"}, game); !apierrors.IsNotFound(err) {
+		t.Errorf("wolf3d is not pruned: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "tyrian"}, game); err != nil {
+		t.Errorf("deployed tyrian is pruned: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(catalog), catalog); err != nil {
+		t.Fatalf("fetching catalog: %v", err)
+	}
+
+	synced := meta.FindStatusCondition(catalog.Status.Conditions, operatorv1beta1.ConditionCatalogSynced)
+	if synced == nil || synced.Status != metav1.ConditionTrue || synced.Reason != "Conflicts" {
+		t.Errorf("synced condition is %+v, expected Conflicts", synced)
+	}
+
+	if catalog.Status.Games != 2 || len(catalog.Status.Conflicts) != 1 || catalog.Status.Conflicts[0] != "prince" {
+		t.Errorf("catalog status is %+v", catalog.Status)
+	}
+}
+
+func TestPullOciIndex(t *testing.T) {
+	layer := []byte(catalogIndexYaml)
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if username, password, _ := r.BasicAuth(); username != "player" || password != "secret" ||
+				r.URL.Query().Get("scope") != "repository:catalogs/dos:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"token": "issued"}`))
+		case r.Header.Get("Authorization") != "Bearer issued":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="registry",scope="repository:catalogs/dos:pull"`, server.URL,
+			))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/catalogs/dos/manifests/v1":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			_, _ = fmt.Fprintf(w, `{"schemaVersion": 2, "layers": [{"digest": %q, "size": %d}]}`, digest, len(layer))
+		case r.URL.Path == "/v2/catalogs/dos/blobs/"+digest:
+			_, _ = w.Write(layer)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	secret := &corev1.Secret{Data: map[string][]byte{
+		credentialsUsernameKey: []byte("player"),
+		credentialsPasswordKey: []byte("secret\n"),
+	}}
+
+	reference := strings.TrimPrefix(server.URL, "http://") + "/catalogs/dos:v1"
+	data, err := pullOciIndex(context.Background(), reference, secret)
+	if err != nil || string(data) != catalogIndexYaml {
+		t.Errorf("pulled %q (%v), expected the index", data, err)
+	}
+}
@@ -0,0 +1,630 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	"github.com/heistp/antler/node/metric"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"math"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionLabel is stamped on the resources of the instance of a
+	// GameSession with its name
+	sessionLabel = "dosbox.contrib/session"
+	// sessionPlayerAnnotation is stamped on the resources of the instance of
+	// a GameSession with its player
+	sessionPlayerAnnotation = "dosbox.contrib/player"
+)
+
+// errInstanceConflict is returned when a resource the instance of a session
+// is named after is controlled by something else, such as a game of the same
+// name or another session
+var errInstanceConflict = errors.New("instance conflicts with another resource")
+
+var (
+	sessionGameEventFilters = builder.WithPredicates(predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// The instances of a game follow its spec and its redeployments,
+			// not the rest of its status, which lists the sessions in turn.
+			oldGame, ok := e.ObjectOld.(*operatorv1beta1.Game)
+			if !ok {
+				return false
+			}
+
+			newGame, ok := e.ObjectNew.(*operatorv1beta1.Game)
+			if !ok {
+				return false
+			}
+
+			return oldGame.Generation != newGame.Generation ||
+				!equality.Semantic.DeepEqual(oldGame.Status.LastRedeployTime, newGame.Status.LastRedeployTime)
+		},
+	})
+)
+
+// sessionInstance holds the resources the instance of a session runs on
+type sessionInstance struct {
+	deployment *appsv1.Deployment
+	cmap       *corev1.ConfigMap
+	pvc        *corev1.PersistentVolumeClaim
+	svc        *corev1.Service
+	ingress    *networkingv1.Ingress
+	route      *unstructured.Unstructured
+}
+
+// GameSessionReconciler reconciles a GameSession object
+type GameSessionReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Games is the game controller, the instance of a session is rendered
+	// the way it renders the game of the session
+	Games *GameReconciler
+}
+
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamesessions,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamesessions/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=gamesessions/finalizers,verbs=update
+
+// Reconcile runs an instance of the game of the session until the session
+// expires, then deletes the session, which takes the instance and its save
+// volume with it. The instance is the game under the instance name of the
+// session: its own deployment, claim, page and service, and its own ingress
+// or route under the path of the game when the game is exposed through one.
+// It is stopped, its saves kept, while the game is undeployed or suspended.
+func (r *GameSessionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithName("session")
+
+	session := &operatorv1beta1.GameSession{}
+	if err := r.Get(ctx, req.NamespacedName, session); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		log.V(5).Error(err, "unable to fetch session")
+		return ctrl.Result{}, err
+	}
+
+	if !session.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	expiresAt := session.ExpiresAt()
+	left := time.Until(expiresAt.Time)
+	if left <= 0 {
+		err := r.Delete(ctx, session, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Error(err, "unable to delete expired session")
+			return ctrl.Result{}, err
+		}
+
+		log.Info(fmt.Sprintf("session %s of %s expired", session.Name, session.Spec.Player))
+		return ctrl.Result{}, nil
+	}
+
+	result := ctrl.Result{RequeueAfter: left}
+
+	game := &operatorv1beta1.Game{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: session.Namespace, Name: session.Spec.GameRef.Name}, game)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.V(5).Error(err, "unable to fetch game")
+			return ctrl.Result{}, err
+		}
+
+		message := fmt.Sprintf("game %s does not exist", session.Spec.GameRef.Name)
+		return result, r.SetStatus(ctx, session, nil, "GameNotFound", message)
+	}
+
+	// the session goes away along with its game
+	if !hasOwnerReference(session, game) {
+		patch := client.MergeFrom(session.DeepCopy())
+		if err := controllerutil.SetOwnerReference(game, session, r.Scheme); err != nil {
+			log.Error(err, "unable to set owner reference")
+			return ctrl.Result{}, err
+		}
+
+		if err := r.Patch(ctx, session, patch); err != nil {
+			log.V(5).Error(err, "unable to patch session")
+			return ctrl.Result{}, err
+		}
+	}
+
+	var jsdos *operatorv1beta1.JsDosRuntime
+	if ref := game.Spec.RuntimeRef; ref != nil {
+		jsdos = &operatorv1beta1.JsDosRuntime{}
+		err := r.Get(ctx, client.ObjectKey{Name: ref.Name}, jsdos)
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.V(5).Error(err, "unable to fetch runtime")
+			return ctrl.Result{}, err
+		}
+
+		if apierrors.IsNotFound(err) || !jsdos.NamespaceReady(session.Namespace) {
+			message := fmt.Sprintf("runtime %s is not ready in namespace %s", ref.Name, session.Namespace)
+			return result, r.SetStatus(ctx, session, nil, "RuntimePopulating", message)
+		}
+	}
+
+	// the assets claim of the namespace is only kept while a game in it is
+	// deployed, so sessions run along with their game
+	stopped := !game.Spec.Deploy || game.Spec.Suspend
+
+	desired, err := r.Render(game, session, jsdos, stopped)
+	if err != nil {
+		log.Error(err, "unable to render session instance")
+		return ctrl.Result{}, err
+	}
+
+	instance, err := r.Apply(ctx, desired)
+	if errors.Is(err, errInstanceConflict) {
+		return result, r.SetStatus(ctx, session, nil, "InstanceConflict", err.Error())
+	}
+	if err != nil {
+		log.Error(err, "unable to apply session instance")
+		return ctrl.Result{}, err
+	}
+
+	observation, err := r.Games.GetStatus(ctx, req, session.InstanceName())
+	if err != nil {
+		log.V(5).Error(err, "unable to fetch pod status")
+		return ctrl.Result{}, err
+	}
+
+	observation.Endpoint = serviceEndpoint(instance.svc)
+	observation.Suspended = stopped
+	observation.URL, err = r.Games.GameUrl(ctx, instanceGame(game, session), instance.svc, instance.ingress, instance.route)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	reason, message := "", ""
+	switch {
+	case !game.Spec.Deploy:
+		reason, message = "GameNotDeployed", fmt.Sprintf("game %s is not deployed, the session is stopped", game.Name)
+	case game.Spec.Suspend:
+		reason, message = "GameSuspended", fmt.Sprintf("game %s is suspended, the session is stopped", game.Name)
+	}
+
+	if err := r.SetStatus(ctx, session, observation, reason, message); err != nil {
+		log.V(5).Error(err, "unable to patch session status")
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// instanceGame is the game the instance of a session runs: the game of the
+// session under the instance name of the session, always on a claim of its
+// own, and served under a path of its own when it shares the host of the
+// game. It is never scaled to zero for lack of traffic, and the instance of
+// a game behind a load balancer is exposed on a node port instead, so that
+// sessions do not cost a load balancer each.
+func instanceGame(game *operatorv1beta1.Game, session *operatorv1beta1.GameSession) *operatorv1beta1.Game {
+	instance := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Namespace: session.Namespace, Name: session.InstanceName()},
+		Spec:       *game.Spec.DeepCopy(),
+	}
+	instance.Status.LastRedeployTime = game.Status.LastRedeployTime
+
+	instance.Spec.Idle = nil
+	instance.Spec.Suspend = false
+	instance.Spec.Persistence.Mode = operatorv1beta1.PersistenceModePersistentVolumeClaim
+	instance.Spec.Exposure.NodePort = 0
+
+	switch instance.Spec.Exposure.Type {
+	case operatorv1beta1.ExposureTypeIngress, operatorv1beta1.ExposureTypeHTTPRoute:
+		instance.Spec.Exposure.Path = fmt.Sprintf("%ssessions/%s/", servedPath(game), session.Name)
+	case operatorv1beta1.ExposureTypeLoadBalancer:
+		instance.Spec.Exposure.Type = operatorv1beta1.ExposureTypeNodePort
+	}
+
+	return instance
+}
+
+// Render renders the resources of the instance of a session, all of them
+// controlled by the session
+func (r *GameSessionReconciler) Render(
+	game *operatorv1beta1.Game,
+	session *operatorv1beta1.GameSession,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	stopped bool,
+) (*sessionInstance, error) {
+	instance := instanceGame(game, session)
+	desired := &sessionInstance{}
+
+	parameters, err := r.Games.deploymentParameters(instance, jsdos, stopped)
+	if err != nil {
+		return nil, err
+	}
+
+	// the page of the instance keeps the saves of the player of the session,
+	// and only of that player, on room kept for them on its claim
+	page := r.Games.configMapParameters(instance)
+	page.Player = session.Spec.Player
+	parameters.SavesPlayer = session.Spec.Player
+	saves := parameters.SavesImage != ""
+
+	if desired.cmap, err = assets.GetConfigMap(page); err != nil {
+		return nil, err
+	}
+
+	if parameters.IndexChecksum, err = indexChecksum(page); err != nil {
+		return nil, err
+	}
+
+	if desired.deployment, err = assets.GetDeployment(parameters); err != nil {
+		return nil, err
+	}
+
+	// the save volume is sized the way the claim of the game is, from the
+	// size of its bundle unless the game sets one, plus the saves quota
+	size := &StorageSize{Mebibytes: r.Games.Sizer.Mebibytes(0)}
+	switch explicit := game.Spec.Persistence.Size; {
+	case explicit != nil && !explicit.IsZero():
+		size.Mebibytes = uint64(math.Ceil(metric.Bytes(explicit.Value()).Mebibytes()))
+	case game.Status.BundleSize != nil:
+		size.BundleLength = game.Status.BundleSize.Value()
+		size.Mebibytes = r.Games.Sizer.Mebibytes(size.BundleLength)
+	}
+
+	if saves {
+		size.Mebibytes += r.Games.Sizer.SavesMebibytes()
+	}
+
+	if desired.pvc, err = newPersistentVolumeClaim(instance, size); err != nil {
+		return nil, err
+	}
+
+	desired.svc, err = assets.GetService(assets.ServiceParameters{
+		Namespace: instance.Namespace,
+		Name:      instance.Name,
+		Port:      instance.Spec.Exposure.Port,
+		Type:      serviceType(instance.Spec.Exposure.Type),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch instance.Spec.Exposure.Type {
+	case operatorv1beta1.ExposureTypeIngress:
+		desired.ingress, err = assets.GetIngress(routeParameters(instance))
+	case operatorv1beta1.ExposureTypeHTTPRoute:
+		desired.route, err = assets.GetHTTPRoute(routeParameters(instance))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range desired.objects() {
+		labels := object.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[sessionLabel] = session.Name
+		object.SetLabels(labels)
+
+		annotations := object.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[sessionPlayerAnnotation] = session.Spec.Player
+		object.SetAnnotations(annotations)
+
+		if err := ctrl.SetControllerReference(session, object, r.Scheme); err != nil {
+			return nil, err
+		}
+	}
+
+	return desired, nil
+}
+
+// objects are the resources of the instance, in the order they are applied
+func (i *sessionInstance) objects() []client.Object {
+	objects := []client.Object{i.pvc, i.cmap, i.deployment, i.svc}
+	if i.ingress != nil {
+		objects = append(objects, i.ingress)
+	}
+	if i.route != nil {
+		objects = append(objects, i.route)
+	}
+
+	return objects
+}
+
+// Apply makes sure the resources of the instance of a session match the
+// desired ones and returns their live state. The save volume is only ever
+// created, as the spec of a claim is immutable. Resources controlled by
+// anything but the session are left alone and errInstanceConflict returned.
+func (r *GameSessionReconciler) Apply(ctx context.Context, desired *sessionInstance) (*sessionInstance, error) {
+	instance := &sessionInstance{pvc: &corev1.PersistentVolumeClaim{}}
+
+	err := r.Get(ctx, client.ObjectKeyFromObject(desired.pvc), instance.pvc)
+	switch {
+	case apierrors.IsNotFound(err):
+		if err := r.apply(ctx, desired.pvc); err != nil {
+			return nil, err
+		}
+		instance.pvc = desired.pvc
+	case err != nil:
+		return nil, err
+	default:
+		if err := r.conflicts(desired.pvc, instance.pvc); err != nil {
+			return nil, err
+		}
+	}
+
+	cmap, err := r.converge(ctx, desired.cmap, &corev1.ConfigMap{}, func(o client.Object) any {
+		return o.(*corev1.ConfigMap).Data
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance.cmap = cmap.(*corev1.ConfigMap)
+
+	deployment, err := r.converge(ctx, desired.deployment, &appsv1.Deployment{}, func(o client.Object) any {
+		return o.(*appsv1.Deployment).Spec
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance.deployment = deployment.(*appsv1.Deployment)
+
+	svc, err := r.converge(ctx, desired.svc, &corev1.Service{}, func(o client.Object) any {
+		return o.(*corev1.Service).Spec
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance.svc = svc.(*corev1.Service)
+
+	if desired.ingress != nil {
+		ingress, err := r.converge(ctx, desired.ingress, &networkingv1.Ingress{}, func(o client.Object) any {
+			return o.(*networkingv1.Ingress).Spec
+		})
+		if err != nil {
+			return nil, err
+		}
+		instance.ingress = ingress.(*networkingv1.Ingress)
+	}
+
+	if desired.route != nil {
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(httpRouteGVK)
+
+		live, err := r.converge(ctx, desired.route, route, func(o client.Object) any {
+			return o.(*unstructured.Unstructured).Object["spec"]
+		})
+		if err != nil {
+			return nil, err
+		}
+		instance.route = live.(*unstructured.Unstructured)
+	}
+
+	return instance, nil
+}
+
+// converge fetches the live object into live, and applies the desired one if
+// it is missing or drifted. It returns the live state either way.
+func (r *GameSessionReconciler) converge(
+	ctx context.Context,
+	desired client.Object,
+	live client.Object,
+	spec func(client.Object) any,
+) (client.Object, error) {
+	err := r.Get(ctx, client.ObjectKeyFromObject(desired), live)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := r.conflicts(desired, live); err != nil {
+			return nil, err
+		}
+	}
+
+	if err == nil && !drifted(desired, live, spec(desired), spec(live)) {
+		return live, nil
+	}
+
+	if err := r.apply(ctx, desired); err != nil {
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+// conflicts returns errInstanceConflict if the live object is controlled by
+// anything but the controller of the desired one
+func (r *GameSessionReconciler) conflicts(desired client.Object, live client.Object) error {
+	owner := metav1.GetControllerOf(desired)
+	controller := metav1.GetControllerOf(live)
+	if controller == nil || owner == nil || controller.UID == owner.UID {
+		return nil
+	}
+
+	kind := "object"
+	if gvk, err := apiutil.GVKForObject(live, r.Scheme); err == nil {
+		kind = strings.ToLower(gvk.Kind)
+	}
+
+	return fmt.Errorf("%w: %s %s is controlled by %s %s", errInstanceConflict,
+		kind, live.GetName(), strings.ToLower(controller.Kind), controller.Name)
+}
+
+func (r *GameSessionReconciler) apply(ctx context.Context, desired client.Object) error {
+	return r.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// SetStatus records the state of the instance of the session. Without an
+// observation, reason and message tell why there is no instance. A reason
+// with an observation tells why the instance is stopped.
+func (r *GameSessionReconciler) SetStatus(
+	ctx context.Context,
+	session *operatorv1beta1.GameSession,
+	observation *GameObservation,
+	reason string,
+	message string,
+) error {
+	patch := client.MergeFrom(session.DeepCopy())
+
+	ready := metav1.Condition{
+		Type:               operatorv1beta1.ConditionSessionReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: session.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+
+	if observation == nil {
+		session.Status.Phase = operatorv1beta1.GamePhasePending
+		session.Status.Endpoint = ""
+		session.Status.URL = ""
+	} else {
+		session.Status.Phase = observation.Phase()
+		session.Status.Endpoint = observation.Endpoint
+		session.Status.URL = observation.URL
+
+		if reason == "" {
+			ready.Status = conditionStatus(observation.Ready)
+			ready.Reason = observation.Reason
+			ready.Message = observation.Message
+		}
+	}
+
+	expiresAt := session.ExpiresAt()
+	session.Status.ExpiresAt = &expiresAt
+	session.Status.ObservedGeneration = session.Generation
+	meta.SetStatusCondition(&session.Status.Conditions, ready)
+
+	return r.Status().Patch(ctx, session, patch)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GameSessionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorv1beta1.GameSession{}).
+		Owns(&appsv1.Deployment{}, dependentEventFilters).
+		Owns(&corev1.Service{}).
+		Owns(&networkingv1.Ingress{}).
+		Watches(
+			&source.Kind{Type: &operatorv1beta1.Game{}},
+			handler.EnqueueRequestsFromMapFunc(r.sessionsForGame),
+			sessionGameEventFilters,
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.sessionForPod),
+			podEventFilters,
+		).
+		Complete(r)
+}
+
+// sessionsForGame maps a game to the sessions running an instance of it
+func (r *GameSessionReconciler) sessionsForGame(object client.Object) []reconcile.Request {
+	sessions, err := listSessions(context.Background(), r.Client, object.GetNamespace(), object.GetName())
+	if err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, session := range sessions {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&session)})
+	}
+
+	return requests
+}
+
+// sessionForPod maps a pod back to the session it is the instance of, using
+// the app label the deployment template stamps on its pods
+func (r *GameSessionReconciler) sessionForPod(object client.Object) []reconcile.Request {
+	name := object.GetLabels()["app"]
+	if name == "" {
+		return nil
+	}
+
+	sessions := &operatorv1beta1.GameSessionList{}
+	if err := r.List(context.Background(), sessions, client.InNamespace(object.GetNamespace())); err != nil {
+		return nil
+	}
+
+	for _, session := range sessions.Items {
+		if session.InstanceName() == name {
+			return []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(&session)}}
+		}
+	}
+
+	return nil
+}
+
+// listSessions lists the sessions of a game, sorted by name
+func listSessions(ctx context.Context, c client.Client, namespace string, game string) ([]operatorv1beta1.GameSession, error) {
+	list := &operatorv1beta1.GameSessionList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	var sessions []operatorv1beta1.GameSession
+	for _, session := range list.Items {
+		if session.Spec.GameRef.Name == game {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name < sessions[j].Name
+	})
+
+	return sessions, nil
+}
+
+// hasOwnerReference reports whether the object references the owner
+func hasOwnerReference(object metav1.Object, owner metav1.Object) bool {
+	for _, reference := range object.GetOwnerReferences() {
+		if reference.UID == owner.GetUID() {
+			return true
+		}
+	}
+
+	return false
+}
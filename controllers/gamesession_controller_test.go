@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestGameSessionRender(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "prince", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameSpec{
+			GameName: "Prince of Persia",
+			Deploy:   true,
+			Suspend:  true,
+			Idle:     &operatorv1beta1.IdleSpec{Minutes: 10},
+			Bundle:   operatorv1beta1.BundleSpec{Url: "https://cdn.dos.zone/original/2X/prince.jsdos"},
+			Exposure: operatorv1beta1.ExposureSpec{
+				Port: 80,
+				Type: operatorv1beta1.ExposureTypeIngress,
+				Host: "arcade.example.com",
+				Path: "/prince",
+			},
+			Persistence: operatorv1beta1.PersistenceSpec{Mode: operatorv1beta1.PersistenceModeEmptyDir},
+		},
+	}
+
+	session := &operatorv1beta1.GameSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "arcade", UID: "1234"},
+		Spec: operatorv1beta1.GameSessionSpec{
+			Player:  "alice",
+			GameRef: corev1.LocalObjectReference{Name: game.Name},
+		},
+	}
+
+	games := newFakeReconciler()
+	games.Sizer = DefaultStorageSizer
+	games.SavesImage = "akyriako78/kube-dosbox:test"
+	r := &GameSessionReconciler{Scheme: games.Scheme, Games: games}
+
+	desired, err := r.Render(game, session, nil, true)
+	if err != nil {
+		t.Fatalf("rendering session: %v", err)
+	}
+
+	for _, object := range desired.objects() {
+		if !metav1.IsControlledBy(object, session) || object.GetLabels()[sessionLabel] != session.Name {
+			t.Errorf("%s is not controlled by the session", object.GetName())
+		}
+	}
+
+	if desired.deployment.Name != "prince-alice" || *desired.deployment.Spec.Replicas != 0 {
+		t.Errorf("deployment of a stopped session is %s with %d replicas", desired.deployment.Name, *desired.deployment.Spec.Replicas)
+	}
+
+	if desired.pvc == nil || desired.pvc.Name != "prince-alice-pvc" {
+		t.Errorf("session has no save volume of its own: %+v", desired.pvc)
+	}
+
+	if desired.ingress == nil || desired.ingress.Spec.Rules[0].HTTP.Paths[0].Path != "/prince/sessions/alice" {
+		t.Errorf("session is not routed under the path of its game: %+v", desired.ingress)
+	}
+
+	containers := desired.deployment.Spec.Template.Spec.Containers
+	if len(containers) != 2 || containers[1].Image != "akyriako78/kube-dosbox:test" {
+		t.Fatalf("session runs no save service: %+v", containers)
+	}
+
+	args := strings.Join(containers[1].Args, " ")
+	if !strings.Contains(args, "--player=alice") || !strings.Contains(args, "--quota=268435456") {
+		t.Errorf("save service of the session keeps the saves of anyone, without limit: %s", args)
+	}
+
+	// the claim keeps room for the saves beside the bundle
+	request := desired.pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if want := int64(DefaultStorageSizer.Mebibytes(0)+256) * 1024 * 1024; request.Value() != want {
+		t.Errorf("save volume requests %s, expected %d bytes", request.String(), want)
+	}
+
+	// the game itself keeps the saves of any player, each behind a token
+	parameters, err := games.deploymentParameters(game, nil, false)
+	if err != nil || parameters.SavesImage != "akyriako78/kube-dosbox:test" || parameters.SavesPlayer != "" ||
+		parameters.SavesQuota != DefaultStorageSizer.Saves || games.configMapParameters(game).SavesPort != savesPort {
+		t.Errorf("game runs no save service for its players (%v): %+v", err, parameters)
+	}
+
+	index := desired.cmap.Data["index.html"]
+	if !strings.Contains(index, `var player = "alice"`) || !strings.Contains(desired.cmap.Data["default.conf"], "location /prince/sessions/alice/saves/ {") {
+		t.Errorf("session page keeps no saves of its player:\n%s\n%s", index, desired.cmap.Data["default.conf"])
+	}
+
+	url, err := r.Games.GameUrl(context.Background(), instanceGame(game, session), desired.svc, desired.ingress, nil)
+	if err != nil || url != "http://arcade.example.com/prince/sessions/alice/" {
+		t.Errorf("session url is %q (%v)", url, err)
+	}
+}
+
+func TestGameSessionExpiry(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec:       operatorv1beta1.GameSpec{Deploy: true},
+	}
+
+	session := func(name string, player string, age time.Duration) *operatorv1beta1.GameSession {
+		return &operatorv1beta1.GameSession{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "arcade",
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+			},
+			Spec: operatorv1beta1.GameSessionSpec{
+				Player:  player,
+				GameRef: corev1.LocalObjectReference{Name: game.Name},
+				TTL:     metav1.Duration{Duration: time.Hour},
+			},
+			Status: operatorv1beta1.GameSessionStatus{Phase: operatorv1beta1.GamePhaseRunning},
+		}
+	}
+
+	expired := session("doom-alice", "alice", 2*time.Hour)
+	running := session("doom-bob", "bob", time.Minute)
+
+	games := newFakeReconciler(game, expired, running)
+	r := &GameSessionReconciler{Client: games.Client, Scheme: games.Scheme, Games: games}
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(expired)}); err != nil {
+		t.Fatalf("reconciling expired session: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(expired), expired); !apierrors.IsNotFound(err) {
+		t.Errorf("expired session is not deleted: %v", err)
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": game.Name}}}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(game)}
+	if _, err := r.Games.RefreshStatus(ctx, req, game, deployment, nil, nil, "", false); err != nil {
+		t.Fatalf("refreshing game status: %v", err)
+	}
+
+	if len(game.Status.Sessions) != 1 || game.Status.Sessions[0].Name != running.Name ||
+		game.Status.Sessions[0].Player != "bob" || game.Status.Sessions[0].Phase != operatorv1beta1.GamePhaseRunning {
+		t.Errorf("game lists sessions %+v, expected the session of bob", game.Status.Sessions)
+	}
+}
+
+func TestGameSessionInstance(t *testing.T) {
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "doom", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameSpec{
+			Deploy:   true,
+			Exposure: operatorv1beta1.ExposureSpec{Port: 80, Type: operatorv1beta1.ExposureTypeLoadBalancer},
+		},
+	}
+
+	session := &operatorv1beta1.GameSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "arcade", UID: "1234"},
+		Spec: operatorv1beta1.GameSessionSpec{
+			Player:  "alice",
+			GameRef: corev1.LocalObjectReference{Name: game.Name},
+		},
+	}
+
+	// a game named after the instance of the session
+	other := &operatorv1beta1.Game{ObjectMeta: metav1.ObjectMeta{Name: "doom-alice", Namespace: "arcade", UID: "5678"}}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "doom-alice-pvc", Namespace: "arcade"}}
+
+	games := newFakeReconciler(game, session)
+	games.Sizer = DefaultStorageSizer
+	if err := ctrl.SetControllerReference(other, pvc, games.Scheme); err != nil {
+		t.Fatalf("setting controller reference: %v", err)
+	}
+	if err := games.Create(context.Background(), pvc); err != nil {
+		t.Fatalf("creating claim: %v", err)
+	}
+
+	r := &GameSessionReconciler{Client: games.Client, Scheme: games.Scheme, Games: games}
+
+	desired, err := r.Render(game, session, nil, false)
+	if err != nil {
+		t.Fatalf("rendering session: %v", err)
+	}
+
+	if desired.svc.Spec.Type != corev1.ServiceTypeNodePort {
+		t.Errorf("instance of a game behind a load balancer is exposed as %s, expected a node port", desired.svc.Spec.Type)
+	}
+
+	if _, err := r.Apply(context.Background(), desired); !errors.Is(err, errInstanceConflict) {
+		t.Errorf("instance takes over the claim of game %s: %v", other.Name, err)
+	}
+
+	long := session.DeepCopy()
+	long.Name = strings.Repeat("a", 80)
+	if name := long.InstanceName(); len(name) > 63 || name == (&operatorv1beta1.GameSession{
+		ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("a", 81)},
+		Spec:       long.Spec,
+	}).InstanceName() {
+		t.Errorf("instance name %q is too long or shared with a longer session name", name)
+	}
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newFakeClient returns a client holding the given objects in memory, with
+// the api types of the operator registered and pods indexed as the manager
+// does. The reconcilers log to the test logger.
+func newFakeClient(objects ...client.Object) client.Client {
+	logger = ctrl.Log.WithName("test")
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = operatorv1beta1.AddToScheme(scheme)
+
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithIndex(&corev1.Pod{}, podIPField, podIP).
+		Build()
+}
+
+// newFakeReconciler returns a GameReconciler on a fake client holding the
+// given objects
+func newFakeReconciler(objects ...client.Object) *GameReconciler {
+	c := newFakeClient(objects...)
+
+	return &GameReconciler{Client: c, Scheme: c.Scheme()}
+}
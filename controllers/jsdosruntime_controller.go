@@ -0,0 +1,389 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strings"
+)
+
+const (
+	// runtimeLabel is stamped on the claims and the jobs of a JsDosRuntime
+	// with its name
+	runtimeLabel = "dosbox.contrib/js-dos-runtime"
+	// runtimeUrlAnnotation is stamped on the job of a JsDosRuntime with the
+	// address it downloads the files of the version from
+	runtimeUrlAnnotation = "dosbox.contrib/js-dos-url"
+	// defaultRuntimeSize is the size of the claims of a JsDosRuntime, unless
+	// it sets spec.size
+	defaultRuntimeSize = "64Mi"
+)
+
+// JsDosRuntimeReconciler reconciles a JsDosRuntime object
+type JsDosRuntimeReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// RuntimeUrl is where js-dos is downloaded from, with {version} standing
+	// in for the version, unless the runtime sets spec.url
+	RuntimeUrl string
+}
+
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=jsdosruntimes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operator.contrib.dosbox.com,resources=jsdosruntimes/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="batch",resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile populates the emulator assets of the runtime in every namespace
+// with a deployed game referencing it, and removes them from the namespaces
+// without one. Claims and jobs are owned by the runtime, so they are garbage
+// collected along with it.
+func (r *JsDosRuntimeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithName("runtime")
+
+	jsdos := &operatorv1beta1.JsDosRuntime{}
+	if err := r.Get(ctx, req.NamespacedName, jsdos); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		log.V(5).Error(err, "unable to fetch runtime")
+		return ctrl.Result{}, err
+	}
+
+	if !jsdos.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	namespaces, err := r.namespaces(ctx, jsdos)
+	if err != nil {
+		log.V(5).Error(err, "unable to list games")
+		return ctrl.Result{}, err
+	}
+
+	var statuses []operatorv1beta1.JsDosRuntimeNamespace
+	for _, namespace := range namespaces {
+		status, err := r.Populate(ctx, jsdos, namespace)
+		if err != nil {
+			log.Error(err, "unable to populate emulator assets", "namespace", namespace)
+			return ctrl.Result{}, err
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	if err := r.Prune(ctx, jsdos, namespaces); err != nil {
+		log.Error(err, "unable to prune emulator assets")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.SetStatus(ctx, jsdos, statuses); err != nil {
+		log.V(5).Error(err, "unable to patch runtime status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// namespaces returns the sorted namespaces with a deployed game referencing
+// the runtime
+func (r *JsDosRuntimeReconciler) namespaces(ctx context.Context, jsdos *operatorv1beta1.JsDosRuntime) ([]string, error) {
+	games := &operatorv1beta1.GameList{}
+	if err := r.List(ctx, games); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var namespaces []string
+	for _, game := range games.Items {
+		if game.Spec.RuntimeRef == nil || game.Spec.RuntimeRef.Name != jsdos.Name {
+			continue
+		}
+
+		if !game.Spec.Deploy || !game.DeletionTimestamp.IsZero() || seen[game.Namespace] {
+			continue
+		}
+
+		seen[game.Namespace] = true
+		namespaces = append(namespaces, game.Namespace)
+	}
+
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// Populate makes sure the claim of the runtime exists in the namespace and
+// that a job downloaded the files of the current version of the runtime to
+// it. A job of an older version or address is replaced.
+func (r *JsDosRuntimeReconciler) Populate(
+	ctx context.Context,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	namespace string,
+) (operatorv1beta1.JsDosRuntimeNamespace, error) {
+	status := operatorv1beta1.JsDosRuntimeNamespace{
+		Namespace: namespace,
+		Reason:    "Populating",
+	}
+
+	parameters := r.parameters(jsdos, namespace)
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: runtimeClaim(jsdos.Name)}, pvc)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return status, err
+		}
+
+		pvc, err = assets.GetRuntimePersistentVolumeClaim(parameters)
+		if err != nil {
+			return status, err
+		}
+
+		if err := ctrl.SetControllerReference(jsdos, pvc, r.Scheme); err != nil {
+			return status, err
+		}
+
+		if err := r.Create(ctx, pvc); err != nil {
+			return status, err
+		}
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: runtimeJob(jsdos.Name)}, job)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return status, err
+		}
+
+		job, err = assets.GetRuntimeJob(parameters)
+		if err != nil {
+			return status, err
+		}
+
+		if err := ctrl.SetControllerReference(jsdos, job, r.Scheme); err != nil {
+			return status, err
+		}
+
+		return status, r.Create(ctx, job)
+	}
+
+	if !job.DeletionTimestamp.IsZero() {
+		return status, nil
+	}
+
+	// the pod template of a job is immutable, so a job of another version is
+	// deleted and created anew once it is gone
+	if job.Annotations[runtimeVersionAnnotation] != parameters.Version || job.Annotations[runtimeUrlAnnotation] != parameters.Url {
+		err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return status, err
+		}
+
+		return status, nil
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case batchv1.JobComplete:
+			status.Ready = true
+			status.Reason = ""
+		case batchv1.JobFailed:
+			status.Reason = "PopulateFailed"
+		}
+	}
+
+	return status, nil
+}
+
+func (r *JsDosRuntimeReconciler) parameters(jsdos *operatorv1beta1.JsDosRuntime, namespace string) assets.RuntimeParameters {
+	url := jsdos.Spec.Url
+	if url == "" {
+		url = r.RuntimeUrl
+	}
+
+	parameters := assets.RuntimeParameters{
+		Namespace:   namespace,
+		Name:        jsdos.Name,
+		Version:     jsdos.Spec.Version,
+		Url:         strings.ReplaceAll(url, "{version}", jsdos.Spec.Version),
+		AccessModes: jsdos.Spec.AccessModes,
+		Storage:     jsdos.Spec.Size.String(),
+	}
+
+	if jsdos.Spec.StorageClassName != nil {
+		parameters.StorageClassName = *jsdos.Spec.StorageClassName
+	}
+
+	if len(parameters.AccessModes) == 0 {
+		parameters.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}
+	}
+
+	if jsdos.Spec.Size.IsZero() {
+		parameters.Storage = defaultRuntimeSize
+	}
+
+	return parameters
+}
+
+// Prune removes the claims and the jobs of the runtime from the namespaces
+// without a deployed game referencing it. Claims still mounted by a pod are
+// only removed once the pod is gone.
+func (r *JsDosRuntimeReconciler) Prune(
+	ctx context.Context,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	namespaces []string,
+) error {
+	keep := map[string]bool{}
+	for _, namespace := range namespaces {
+		keep[namespace] = true
+	}
+
+	selector := client.MatchingLabels{runtimeLabel: jsdos.Name}
+
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, selector); err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		if keep[jobs.Items[i].Namespace] {
+			continue
+		}
+
+		err := r.Delete(ctx, &jobs.Items[i], client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, selector); err != nil {
+		return err
+	}
+
+	for i := range pvcs.Items {
+		if keep[pvcs.Items[i].Namespace] {
+			continue
+		}
+
+		err := r.Delete(ctx, &pvcs.Items[i])
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetStatus records the state of the emulator assets in every namespace and
+// sums it up in the Ready condition
+func (r *JsDosRuntimeReconciler) SetStatus(
+	ctx context.Context,
+	jsdos *operatorv1beta1.JsDosRuntime,
+	statuses []operatorv1beta1.JsDosRuntimeNamespace,
+) error {
+	patch := client.MergeFrom(jsdos.DeepCopy())
+
+	ready := metav1.Condition{
+		Type:               operatorv1beta1.ConditionRuntimeReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: jsdos.Generation,
+		Reason:             "Populated",
+		Message:            fmt.Sprintf("emulator assets are in place in %d namespaces", len(statuses)),
+	}
+
+	var populating, failed []string
+	for _, status := range statuses {
+		switch {
+		case status.Reason == "PopulateFailed":
+			failed = append(failed, status.Namespace)
+		case !status.Ready:
+			populating = append(populating, status.Namespace)
+		}
+	}
+
+	switch {
+	case len(failed) > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "PopulateFailed"
+		ready.Message = fmt.Sprintf("unable to populate emulator assets in %s", strings.Join(failed, ", "))
+	case len(populating) > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "Populating"
+		ready.Message = fmt.Sprintf("populating emulator assets in %s", strings.Join(populating, ", "))
+	}
+
+	jsdos.Status.Namespaces = statuses
+	jsdos.Status.ObservedGeneration = jsdos.Generation
+	meta.SetStatusCondition(&jsdos.Status.Conditions, ready)
+
+	return r.Status().Patch(ctx, jsdos, patch)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *JsDosRuntimeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorv1beta1.JsDosRuntime{}).
+		Owns(&batchv1.Job{}).
+		Watches(
+			&source.Kind{Type: &operatorv1beta1.Game{}},
+			handler.EnqueueRequestsFromMapFunc(r.runtimeForGame),
+			dependentEventFilters,
+		).
+		Complete(r)
+}
+
+// runtimeForGame maps a game to the runtime it references. Both the old and
+// the new game of an update are mapped, so a runtime a game no longer
+// references prunes its namespace.
+func (r *JsDosRuntimeReconciler) runtimeForGame(object client.Object) []reconcile.Request {
+	game, ok := object.(*operatorv1beta1.Game)
+	if !ok || game.Spec.RuntimeRef == nil {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: game.Spec.RuntimeRef.Name}}}
+}
+
+// runtimeClaim is the claim the emulator assets of a runtime are kept on
+func runtimeClaim(name string) string {
+	return fmt.Sprintf("js-dos-%s-pvc", name)
+}
+
+// runtimeJob is the job populating the emulator assets of a runtime
+func runtimeJob(name string) string {
+	return fmt.Sprintf("js-dos-%s", name)
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestJsDosRuntimePopulatesNamespaces(t *testing.T) {
+	jsdos := &operatorv1beta1.JsDosRuntime{
+		ObjectMeta: metav1.ObjectMeta{Name: "js-dos-7", Generation: 1},
+		Spec:       operatorv1beta1.JsDosRuntimeSpec{Version: "7.4.7"},
+	}
+
+	game := &operatorv1beta1.Game{
+		ObjectMeta: metav1.ObjectMeta{Name: "packman", Namespace: "arcade"},
+		Spec: operatorv1beta1.GameSpec{
+			Deploy:     true,
+			RuntimeRef: &corev1.LocalObjectReference{Name: jsdos.Name},
+		},
+	}
+
+	c := newFakeClient(jsdos, game)
+	r := &JsDosRuntimeReconciler{
+		Client:     c,
+		Scheme:     c.Scheme(),
+		RuntimeUrl: "https://cdn.jsdelivr.net/npm/js-dos@{version}/dist",
+	}
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Name: jsdos.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %v", err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "js-dos-js-dos-7-pvc"}, pvc); err != nil {
+		t.Fatalf("claim is not created: %v", err)
+	}
+
+	if pvc.Spec.AccessModes[0] != corev1.ReadWriteMany || pvc.Spec.Resources.Requests.Storage().String() != defaultRuntimeSize {
+		t.Errorf("claim is not defaulted: %+v", pvc.Spec)
+	}
+
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "arcade", Name: "js-dos-js-dos-7"}, job); err != nil {
+		t.Fatalf("job is not created: %v", err)
+	}
+
+	if url := job.Annotations[runtimeUrlAnnotation]; url != "https://cdn.jsdelivr.net/npm/js-dos@7.4.7/dist" {
+		t.Errorf("job downloads from %s", url)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := r.Status().Update(ctx, job); err != nil {
+		t.Fatalf("completing job: %v", err)
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %v", err)
+	}
+
+	if err := r.Get(ctx, req.NamespacedName, jsdos); err != nil {
+		t.Fatalf("fetching runtime: %v", err)
+	}
+
+	if !jsdos.NamespaceReady("arcade") || jsdos.NamespaceReady("default") {
+		t.Errorf("runtime status is %+v", jsdos.Status)
+	}
+
+	// a namespace without games left is pruned
+	game.Spec.Deploy = false
+	if err := r.Update(ctx, game); err != nil {
+		t.Fatalf("undeploying game: %v", err)
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %v", err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(job), job); err == nil {
+		t.Errorf("job of a namespace without games is kept")
+	}
+}
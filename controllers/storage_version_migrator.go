@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	gamesCustomResourceDefinition = "games.operator.contrib.dosbox.com"
+)
+
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=update;patch
+
+// StorageVersionMigrator rewrites the games still persisted in an older
+// version of the API in the current storage version, and then drops the older
+// versions from the stored versions of the CRD, so they can be retired in a
+// later release. It runs once, on the elected manager.
+type StorageVersionMigrator struct {
+	client.Client
+	// Reader reads straight from the api server, so neither the CRD nor the
+	// games have to be cached just for a one-off migration
+	Reader client.Reader
+}
+
+// Start implements manager.Runnable
+func (m *StorageVersionMigrator) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("migrator")
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := m.Reader.Get(ctx, client.ObjectKey{Name: gamesCustomResourceDefinition}, crd); err != nil {
+		log.Error(err, "unable to fetch crd")
+		return err
+	}
+
+	storageVersion := ""
+	for _, version := range crd.Spec.Versions {
+		if version.Storage {
+			storageVersion = version.Name
+		}
+	}
+
+	if len(crd.Status.StoredVersions) == 1 && crd.Status.StoredVersions[0] == storageVersion {
+		return nil
+	}
+
+	games := &operatorv1beta1.GameList{}
+	if err := m.Reader.List(ctx, games); err != nil {
+		log.Error(err, "unable to list games")
+		return err
+	}
+
+	// an update that changes nothing is still persisted in the storage
+	// version; a conflict means someone else just wrote the game, which
+	// migrated it all the same
+	for i := range games.Items {
+		err := m.Update(ctx, &games.Items[i])
+		if err != nil && !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+			log.Error(err, "unable to migrate game", "namespace", games.Items[i].Namespace, "name", games.Items[i].Name)
+			return err
+		}
+	}
+
+	patch := client.MergeFrom(crd.DeepCopy())
+	crd.Status.StoredVersions = []string{storageVersion}
+
+	if err := m.Status().Patch(ctx, crd, patch); err != nil {
+		log.Error(err, "unable to patch crd stored versions")
+		return err
+	}
+
+	log.Info(fmt.Sprintf("%d games are migrated to %s", len(games.Items), storageVersion))
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (m *StorageVersionMigrator) NeedLeaderElection() bool {
+	return true
+}
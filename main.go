@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"go.uber.org/zap/zapcore"
 	"os"
@@ -25,14 +26,20 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	operatorv1alpha1 "github.com/akyriako/kube-dosbox/api/v1alpha1"
+	operatorv1beta1 "github.com/akyriako/kube-dosbox/api/v1beta1"
+	"github.com/akyriako/kube-dosbox/assets"
 	"github.com/akyriako/kube-dosbox/controllers"
 	//+kubebuilder:scaffold:imports
 )
@@ -44,8 +51,10 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(operatorv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(operatorv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -53,11 +62,45 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var verifyBundleUrl bool
+	var runtimeVersion string
+	var runtimeUrl string
+	var runtimeAddr string
+	var storageHeadroom int
+	var storageReserve string
+	var storageSaves string
+	var arcadeNamespace string
+	var activatorAddr string
+	var activatorIp string
+	var savesImage string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&verifyBundleUrl, "verify-bundle-url", false,
+		"Reject games whose bundle url is unreachable or does not point to a zip archive.")
+	flag.StringVar(&runtimeVersion, "js-dos-version", "7.4.7",
+		"The js-dos version games run on, unless they set spec.runtime.version.")
+	flag.StringVar(&runtimeUrl, "js-dos-url", "https://cdn.jsdelivr.net/npm/js-dos@{version}/dist",
+		"The address js-dos is downloaded from, {version} is replaced with the version a game runs on.")
+	flag.StringVar(&runtimeAddr, "runtime-bind-address", "0",
+		"The address the js-dos versions embedded into the manager are served at. Set it to 0 to disable serving them.")
+	flag.IntVar(&storageHeadroom, "storage-headroom", controllers.DefaultStorageSizer.Headroom,
+		"The headroom added on top of the bundle of a game when sizing its storage, in percent of the bundle size.")
+	flag.StringVar(&storageReserve, "storage-reserve", "10Mi",
+		"The storage added on top of the bundle of a game and its headroom, for the files served next to it.")
+	flag.StringVar(&storageSaves, "storage-saves", "256Mi",
+		"How much the saves of a game or a game session may take, which is added to the claim of a session.")
+	flag.StringVar(&arcadeNamespace, "arcade-namespace", "",
+		"The namespace the arcade, a landing page listing every game, runs in. Leave it empty to run no arcade.")
+	flag.StringVar(&activatorAddr, "activator-bind-address", "0",
+		"The address the activator in front of the games with spec.idle listens at. Set it to 0 to never scale games to zero.")
+	flag.StringVar(&activatorIp, "activator-ip", os.Getenv("POD_IP"),
+		"The ip the services of the games with spec.idle send their requests to, the ip of the manager pod.")
+	flag.StringVar(&savesImage, "saves-image", "",
+		"The image the save service deployed alongside every game and game session runs from. Defaults to the image of the "+
+			"manager pod, they have no save service if the manager does not run in a pod.")
 	opts := zap.Options{
 		Development:     true,
 		StacktraceLevel: zapcore.DPanicLevel,
@@ -67,6 +110,18 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	reserve, err := resource.ParseQuantity(storageReserve)
+	if err != nil {
+		setupLog.Error(err, "unable to parse --storage-reserve")
+		os.Exit(1)
+	}
+
+	saves, err := resource.ParseQuantity(storageSaves)
+	if err != nil {
+		setupLog.Error(err, "unable to parse --storage-saves")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -91,13 +146,106 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.GameReconciler{
+	var activator *controllers.Activator
+	if activatorAddr != "0" {
+		if activatorIp == "" {
+			setupLog.Error(nil, "the activator needs --activator-ip or POD_IP")
+			os.Exit(1)
+		}
+
+		activator = &controllers.Activator{Addr: activatorAddr, Ip: activatorIp}
+		if _, err := activator.Port(); err != nil {
+			setupLog.Error(err, "unable to parse --activator-bind-address")
+			os.Exit(1)
+		}
+	}
+
+	if savesImage == "" {
+		savesImage, err = managerImage(mgr.GetAPIReader())
+		if err != nil {
+			setupLog.Error(err, "unable to look up the image of the manager pod")
+			os.Exit(1)
+		}
+	}
+
+	gameReconciler := &controllers.GameReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		RuntimeVersion: runtimeVersion,
+		RuntimeUrl:     runtimeUrl,
+		Sizer: controllers.StorageSizer{
+			Headroom: storageHeadroom,
+			Reserve:  reserve.Value(),
+			Saves:    saves.Value(),
+		},
+		Activator:  activator,
+		SavesImage: savesImage,
+	}
+	if err = gameReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Game")
+		os.Exit(1)
+	}
+	if err = (&controllers.JsDosRuntimeReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		RuntimeUrl: runtimeUrl,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "JsDosRuntime")
+		os.Exit(1)
+	}
+	if err = (&controllers.GameCatalogReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Game")
+		setupLog.Error(err, "unable to create controller", "controller", "GameCatalog")
+		os.Exit(1)
+	}
+	if err = (&controllers.GameSessionReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Games:  gameReconciler,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GameSession")
 		os.Exit(1)
 	}
+	if arcadeNamespace != "" {
+		if err = (&controllers.ArcadeReconciler{
+			Client:    mgr.GetClient(),
+			Scheme:    mgr.GetScheme(),
+			Namespace: arcadeNamespace,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Arcade")
+			os.Exit(1)
+		}
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&operatorv1beta1.Game{}).SetupWebhookWithManager(mgr, verifyBundleUrl); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Game")
+			os.Exit(1)
+		}
+		// games stored as v1alpha1 can only be read back through the
+		// conversion webhook, so they are only migrated when it is served
+		if err = mgr.Add(&controllers.StorageVersionMigrator{
+			Client: mgr.GetClient(),
+			Reader: mgr.GetAPIReader(),
+		}); err != nil {
+			setupLog.Error(err, "unable to create storage version migrator")
+			os.Exit(1)
+		}
+	}
+	if runtimeAddr != "0" {
+		versions, err := assets.GetRuntimeVersions()
+		if err != nil {
+			setupLog.Error(err, "unable to read embedded js-dos versions")
+			os.Exit(1)
+		}
+
+		setupLog.Info("serving embedded js-dos", "address", runtimeAddr, "versions", versions)
+		if err = mgr.Add(&assets.RuntimeServer{Addr: runtimeAddr}); err != nil {
+			setupLog.Error(err, "unable to create js-dos runtime server")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -115,3 +263,25 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// managerImage returns the image of the manager container of the pod named by
+// POD_NAME and POD_NAMESPACE, or nothing if the manager does not run in a pod
+func managerImage(reader client.Reader) (string, error) {
+	name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if name == "" || namespace == "" {
+		return "", nil
+	}
+
+	pod := &corev1.Pod{}
+	if err := reader.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, pod); err != nil {
+		return "", err
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == "manager" {
+			return container.Image, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package saves is the save service running next to every game and the
+// instance of every game session. It keeps the js-dos save archives of their
+// players on their storage, so the progress of a player follows them across
+// browsers and devices.
+package saves
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxSize is the largest archive the service stores, unless it sets
+	// MaxSize
+	DefaultMaxSize = 64 * 1024 * 1024
+	// TokenHeader is the header requests carry the token of their player in,
+	// unless they carry it in the token query parameter
+	TokenHeader = "X-Save-Token"
+	// keyLength is the length of the keys tokens are signed with, in bytes
+	keyLength = 32
+)
+
+var (
+	// namePattern is what the names of players and archives look like. They
+	// never start with a dot, which keeps uploads in progress out of sight.
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]{0,127}$`)
+)
+
+// Save is an archive of a player, as listed by the service
+type Save struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Credentials name a player and carry the token its archives are reached with
+type Credentials struct {
+	Player string `json:"player"`
+	Token  string `json:"token"`
+}
+
+// Server serves the save archives of the players of a game, each player in a
+// directory of its own under Root:
+//
+//	POST   /saves/                  makes up a player and hands out its credentials
+//	GET    /saves/<player>/         lists the archives of the player
+//	GET    /saves/<player>/<name>   downloads an archive
+//	PUT    /saves/<player>/<name>   stores an archive, replacing it
+//	DELETE /saves/<player>/<name>   deletes an archive
+//
+// Requests for the archives of a player carry its token, the HMAC-SHA256 of
+// its name signed with Key, so players only reach their own archives. When
+// Player is set, the credentials handed out are those of Player and the
+// archives of any other player are refused.
+type Server struct {
+	// Addr is the address the service listens at
+	Addr string
+	// Root is the directory the archives are kept under
+	Root string
+	// Key signs the tokens of the players
+	Key []byte
+	// MaxSize is the largest archive stored, in bytes
+	MaxSize int64
+	// Player is the only player served, if set
+	Player string
+	// Quota is how many bytes all archives together may take, if set
+	Quota int64
+	// Log is where failures are reported
+	Log logr.Logger
+}
+
+// Start serves the archives until the context is done
+func (s *Server) Start(ctx context.Context) error {
+	if len(s.Key) == 0 {
+		return errors.New("save service has no key to sign tokens with")
+	}
+
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/saves/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	player, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/saves/"), "/")
+	if player == "" && r.Method == http.MethodPost {
+		s.credentials(w, r)
+		return
+	}
+
+	if !namePattern.MatchString(player) || (name != "" && !namePattern.MatchString(name)) {
+		http.Error(w, "names of players and saves are made of letters, digits and ._@+-", http.StatusBadRequest)
+		return
+	}
+
+	if s.Player != "" && player != s.Player {
+		http.Error(w, fmt.Sprintf("only the saves of %s are kept here", s.Player), http.StatusForbidden)
+		return
+	}
+
+	token := r.Header.Get(TokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	switch {
+	case token == "":
+		http.Error(w, fmt.Sprintf("saves of a player need its token in %s", TokenHeader), http.StatusUnauthorized)
+		return
+	case !hmac.Equal([]byte(token), []byte(s.Token(player))):
+		http.Error(w, fmt.Sprintf("token is not the one of %s", player), http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case name == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.list(w, r, player)
+	case name == "":
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.download(w, r, player, name)
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		s.store(w, r, player, name)
+	case r.Method == http.MethodDelete:
+		s.delete(w, r, player, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Token returns the token of a player
+func (s *Server) Token(player string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(player))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// credentials hands out a player made up on the spot, or Player if set, with
+// its token
+func (s *Server) credentials(w http.ResponseWriter, r *http.Request) {
+	player := s.Player
+	if player == "" {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			s.fail(w, err, "unable to make up player")
+			return
+		}
+
+		player = "player-" + hex.EncodeToString(suffix)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(Credentials{Player: player, Token: s.Token(player)})
+}
+
+// LoadKey reads the key tokens are signed with from a file, and creates the
+// file with a random key first if there is none. Keeping the key next to the
+// archives keeps the tokens of the players valid as long as their archives.
+func LoadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return key, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	key = make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		// another replica of the game got there first
+		if errors.Is(err, fs.ErrExist) {
+			return os.ReadFile(path)
+		}
+
+		return nil, err
+	}
+
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return key, err
+}
+
+// List returns the archives of a player, sorted by name
+func (s *Server) List(player string) ([]Save, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, player))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []Save{}, nil
+		}
+
+		return nil, err
+	}
+
+	saves := []Save{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !namePattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		saves = append(saves, Save{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime().UTC()})
+	}
+
+	sort.Slice(saves, func(i, j int) bool {
+		return saves[i].Name < saves[j].Name
+	})
+
+	return saves, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, player string) {
+	saves, err := s.List(player)
+	if err != nil {
+		s.fail(w, err, "unable to list saves", "player", player)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(saves)
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, player string, name string) {
+	file, err := os.Open(filepath.Join(s.Root, player, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.fail(w, err, "unable to open save", "player", player, "save", name)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// store writes the archive next to its destination first and renames it in
+// place, so a failed upload never clobbers the previous save
+func (s *Server) store(w http.ResponseWriter, r *http.Request, player string, name string) {
+	maxSize := s.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if r.ContentLength > maxSize {
+		http.Error(w, fmt.Sprintf("saves are limited to %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	directory := filepath.Join(s.Root, player)
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		s.fail(w, err, "unable to create player directory", "player", player)
+		return
+	}
+
+	upload, err := os.CreateTemp(directory, ".upload-*")
+	if err != nil {
+		s.fail(w, err, "unable to create save", "player", player, "save", name)
+		return
+	}
+	defer os.Remove(upload.Name())
+
+	written, err := io.Copy(upload, http.MaxBytesReader(w, r.Body, maxSize))
+	if closeErr := upload.Close(); err == nil {
+		err = closeErr
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("saves are limited to %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		s.fail(w, err, "unable to write save", "player", player, "save", name)
+		return
+	case written == 0:
+		http.Error(w, "save is empty", http.StatusBadRequest)
+		return
+	}
+
+	if s.Quota > 0 {
+		used, err := s.usage(filepath.Join(directory, name))
+		if err != nil {
+			s.fail(w, err, "unable to measure saves", "player", player)
+			return
+		}
+
+		if used+written > s.Quota {
+			http.Error(w, fmt.Sprintf("saves are limited to %d bytes altogether", s.Quota), http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	if err := os.Rename(upload.Name(), filepath.Join(directory, name)); err != nil {
+		s.fail(w, err, "unable to store save", "player", player, "save", name)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// usage returns how many bytes the stored archives take, but for the one at
+// the given path, which is about to be replaced
+func (s *Server) usage(replaced string) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(s.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() || path == replaced || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		used += info.Size()
+
+		return nil
+	})
+
+	return used, err
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, player string, name string) {
+	err := os.Remove(filepath.Join(s.Root, player, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.fail(w, err, "unable to delete save", "player", player, "save", name)
+		return
+	}
+
+	// the directory of a player goes away along with the last save
+	_ = os.Remove(filepath.Join(s.Root, player))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) fail(w http.ResponseWriter, err error, message string, keysAndValues ...interface{}) {
+	s.Log.Error(err, message, keysAndValues...)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
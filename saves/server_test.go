@@ -0,0 +1,206 @@
+package saves
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestServer(t *testing.T) {
+	root := t.TempDir()
+	saves := &Server{Root: root, Key: []byte("key"), MaxSize: 16, Log: ctrl.Log.WithName("test")}
+	server := httptest.NewServer(saves)
+	defer server.Close()
+
+	do := func(method string, path string, body string) *http.Response {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("building %s %s: %v", method, path, err)
+		}
+		request.Header.Set(TokenHeader, saves.Token(pathPlayer(path)))
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { response.Body.Close() })
+
+		return response
+	}
+
+	if response := do(http.MethodGet, "/saves/alice/latest.jsdos", ""); response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing save is %d, expected 404", response.StatusCode)
+	}
+
+	if response := do(http.MethodPut, "/saves/alice/latest.jsdos", "level 3"); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("storing save is %d, expected 204", response.StatusCode)
+	}
+
+	response := do(http.MethodGet, "/saves/alice/latest.jsdos", "")
+	content := make([]byte, 16)
+	n, _ := response.Body.Read(content)
+	if response.StatusCode != http.StatusOK || string(content[:n]) != "level 3" {
+		t.Errorf("downloaded save is %d %q", response.StatusCode, content[:n])
+	}
+
+	if response := do(http.MethodGet, "/saves/bob/latest.jsdos", ""); response.StatusCode != http.StatusNotFound {
+		t.Errorf("save of alice is served to bob: %d", response.StatusCode)
+	}
+
+	var listed []Save
+	if err := json.NewDecoder(do(http.MethodGet, "/saves/alice/", "").Body).Decode(&listed); err != nil {
+		t.Fatalf("decoding saves: %v", err)
+	}
+	if len(listed) != 1 || listed[0].Name != "latest.jsdos" || listed[0].Size != 7 {
+		t.Errorf("alice has saves %+v", listed)
+	}
+
+	if response := do(http.MethodPut, "/saves/alice/latest.jsdos", strings.Repeat("x", 17)); response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("storing too large a save is %d, expected 413", response.StatusCode)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(root, "alice", "latest.jsdos")); string(content) != "level 3" {
+		t.Errorf("failed upload replaced the save with %q", content)
+	}
+
+	for _, path := range []string{"/saves/../etc/passwd", "/saves/alice/.upload-1", "/saves/al ice/latest.jsdos"} {
+		if response := do(http.MethodGet, path, ""); response.StatusCode != http.StatusBadRequest && response.StatusCode != http.StatusNotFound {
+			t.Errorf("%s is %d, expected to be refused", path, response.StatusCode)
+		}
+	}
+
+	if response := do(http.MethodDelete, "/saves/alice/latest.jsdos", ""); response.StatusCode != http.StatusNoContent {
+		t.Errorf("deleting save is %d, expected 204", response.StatusCode)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "alice")); !os.IsNotExist(err) {
+		t.Errorf("directory of alice outlives her last save: %v", err)
+	}
+}
+
+func TestServerPlayerQuota(t *testing.T) {
+	root := t.TempDir()
+	saves := &Server{Root: root, Key: []byte("key"), MaxSize: 16, Player: "alice", Quota: 24, Log: ctrl.Log.WithName("test")}
+	server := httptest.NewServer(saves)
+	defer server.Close()
+
+	do := func(method string, path string, body string) int {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("building %s %s: %v", method, path, err)
+		}
+		request.Header.Set(TokenHeader, saves.Token(pathPlayer(path)))
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	for _, path := range []string{"/saves/bob/", "/saves/bob/latest.jsdos"} {
+		if status := do(http.MethodGet, path, ""); status != http.StatusForbidden {
+			t.Errorf("%s of another player is %d, expected 403", path, status)
+		}
+	}
+
+	if status := do(http.MethodPut, "/saves/bob/latest.jsdos", "level 1"); status != http.StatusForbidden {
+		t.Errorf("storing a save of another player is %d, expected 403", status)
+	}
+
+	if status := do(http.MethodPut, "/saves/alice/latest.jsdos", strings.Repeat("x", 12)); status != http.StatusNoContent {
+		t.Fatalf("storing save is %d, expected 204", status)
+	}
+
+	// replacing a save only counts its new size
+	if status := do(http.MethodPut, "/saves/alice/latest.jsdos", strings.Repeat("x", 16)); status != http.StatusNoContent {
+		t.Errorf("replacing save is %d, expected 204", status)
+	}
+
+	if status := do(http.MethodPut, "/saves/alice/slot1.jsdos", strings.Repeat("x", 9)); status != http.StatusInsufficientStorage {
+		t.Errorf("storing a save beyond the quota is %d, expected 507", status)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "alice", "slot1.jsdos")); !os.IsNotExist(err) {
+		t.Errorf("save beyond the quota is kept: %v", err)
+	}
+}
+
+func TestServerTokens(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), ".saves", ".key")
+	key, err := LoadKey(keyFile)
+	if err != nil || len(key) != keyLength {
+		t.Fatalf("loading key: %v", err)
+	}
+
+	saves := &Server{Root: t.TempDir(), Key: key, Log: ctrl.Log.WithName("test")}
+	server := httptest.NewServer(saves)
+	defer server.Close()
+
+	do := func(method string, path string, token string, body string) *http.Response {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("building %s %s: %v", method, path, err)
+		}
+		if token != "" {
+			request.Header.Set(TokenHeader, token)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { response.Body.Close() })
+
+		return response
+	}
+
+	var alice, bob Credentials
+	for _, credentials := range []*Credentials{&alice, &bob} {
+		if err := json.NewDecoder(do(http.MethodPost, "/saves/", "", "").Body).Decode(credentials); err != nil {
+			t.Fatalf("decoding credentials: %v", err)
+		}
+	}
+
+	if !namePattern.MatchString(alice.Player) || alice.Player == bob.Player || alice.Token != saves.Token(alice.Player) {
+		t.Fatalf("service hands out the credentials %+v and %+v", alice, bob)
+	}
+
+	save := "/saves/" + alice.Player + "/latest.jsdos"
+	if response := do(http.MethodPut, save, alice.Token, "level 3"); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("storing save is %d, expected 204", response.StatusCode)
+	}
+
+	if response := do(http.MethodGet, save, "", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("save without a token is %d, expected 401", response.StatusCode)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if response := do(method, save, bob.Token, "level 1"); response.StatusCode != http.StatusForbidden {
+			t.Errorf("%s of a save of alice by bob is %d, expected 403", method, response.StatusCode)
+		}
+	}
+
+	if response := do(http.MethodGet, save+"?token="+alice.Token, "", ""); response.StatusCode != http.StatusOK {
+		t.Errorf("save with the token in its address is %d, expected 200", response.StatusCode)
+	}
+
+	// the key outlives the service, along with the saves
+	if again, err := LoadKey(keyFile); err != nil || string(again) != string(key) {
+		t.Errorf("key is not kept across restarts: %v", err)
+	}
+}
+
+// pathPlayer returns the player the archives at path are of
+func pathPlayer(path string) string {
+	player, _, _ := strings.Cut(strings.TrimPrefix(path, "/saves/"), "/")
+	return player
+}